@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"docker-tar-push-ui/pkg/auth"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// AuthCmd 生成认证配置文件里需要的密码哈希和 API Token
+	AuthCmd = &cobra.Command{
+		Use:   "auth",
+		Short: "helpers for the server auth config file",
+	}
+
+	hashPasswordCmd = &cobra.Command{
+		Use:   "hash-password [password]",
+		Short: "print the bcrypt hash of a password (reads stdin if not given)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			password := ""
+			if len(args) == 1 {
+				password = args[0]
+			} else {
+				line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && line == "" {
+					return err
+				}
+				password = strings.TrimRight(line, "\r\n")
+			}
+			if password == "" {
+				return fmt.Errorf("password is empty")
+			}
+			hash, err := auth.HashPassword(password)
+			if err != nil {
+				return err
+			}
+			fmt.Println(hash)
+			return nil
+		},
+	}
+
+	tokenCmd = &cobra.Command{
+		Use:   "token",
+		Short: "generate a random api token and its hash",
+		Run: func(cmd *cobra.Command, args []string) {
+			token := auth.NewToken()
+			fmt.Printf("token:     %s\ntokenHash: %s\n", token, auth.HashToken(token))
+		},
+	}
+)
+
+func init() {
+	AuthCmd.AddCommand(hashPasswordCmd)
+	AuthCmd.AddCommand(tokenCmd)
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"docker-tar-push-ui/pkg/push"
+
+	"github.com/silenceper/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkOpts struct {
+		registryOptions
+		imagePrefix string
+		repository  string
+		write       bool
+		json        bool
+	}
+
+	CheckCmd = &cobra.Command{
+		Use:   "check",
+		Short: "check registry connection, auth and push permission before pushing",
+		Long: `check registry connection, auth and push permission before pushing.
+
+It calls /v2/, reports the auth scheme and token endpoint, verifies the credentials,
+requests a push token for the target repository and starts (then cancels) an upload.
+With --write a 2 byte blob is pushed to the sibling repository
+docker-tar-push-check-src and mounted into the checked repository, and an
+untagged manifest is pushed, to detect cross-repo mount and OCI media type support.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			imagePush, err := checkOpts.client(nil)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			repository := checkOpts.repository
+			if repository == "" {
+				repository = path.Join(checkOpts.imagePrefix, push.CheckRepository)
+			}
+			report := imagePush.Check(ctx, repository, checkOpts.write)
+			if checkOpts.json {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(report)
+			} else {
+				printCheckReport(report)
+			}
+			if !report.OK {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func printCheckReport(report *push.CheckReport) {
+	fmt.Printf("registry: %s\n", report.Registry)
+	if report.Repository != "" {
+		fmt.Printf("repository: %s\n", report.Repository)
+	}
+	for _, item := range report.Items {
+		fmt.Printf("[%-4s] %-8s %s\n", item.Status, item.Name, item.Message)
+	}
+	if report.AuthScheme != "" {
+		fmt.Printf("auth: %s", report.AuthScheme)
+		if report.TokenEndpoint != "" {
+			fmt.Printf(", token endpoint %s", report.TokenEndpoint)
+			if report.Service != "" {
+				fmt.Printf(" (service %s)", report.Service)
+			}
+		}
+		fmt.Println()
+	}
+	fmt.Printf("cross-repo mount: %s, oci: %s\n", report.CrossRepoMount, report.OCI)
+	if report.OK {
+		fmt.Println("result: ok")
+	} else {
+		fmt.Println("result: failed")
+	}
+}
+
+func init() {
+	f := CheckCmd.Flags()
+	checkOpts.addFlags(f)
+	f.StringVar(&checkOpts.imagePrefix, "image-prefix", "", "image repo prefix, used to build the repository to check")
+	f.StringVar(&checkOpts.repository, "repository", "", "repository to check push permission, default <image-prefix>/"+push.CheckRepository)
+	f.BoolVar(&checkOpts.write, "write", false, "push a test blob and manifest to detect cross-repo mount and OCI support")
+	f.BoolVar(&checkOpts.json, "json", false, "print the result as json")
+
+	CheckCmd.MarkFlagRequired("registry")
+}
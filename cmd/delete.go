@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/silenceper/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	deleteOpts struct {
+		registryOptions
+		yes bool
+	}
+
+	DeleteCmd = &cobra.Command{
+		Use:   "delete <image:tag|image@digest>",
+		Short: "delete an image tag or manifest from the registry",
+		Long: `delete an image tag or manifest from the registry.
+
+The tag is resolved to its manifest digest and the manifest is deleted,
+so every tag pointing to the same digest is removed as well.
+The registry can be given in the reference, e.g. harbor.example.com/library/nginx:1.25.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ref, err := util.ParseReference(args[0])
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			if ref.Reference() == "" {
+				log.Fatalf("tag or digest is required, e.g. %s:1.0", ref)
+			}
+			imagePush, err := deleteOpts.client(ref)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			digest, err := imagePush.ResolveDigest(ctx, ref.Repository, ref.Reference())
+			if err != nil {
+				log.Fatalf("resolve %s: %v", args[0], err)
+			}
+			if ref.Digest != "" && ref.Digest != digest {
+				log.Fatalf("%s resolves to %s, not %s", args[0], digest, ref.Digest)
+			}
+			target := fmt.Sprintf("%s/%s@%s", imagePush.Registry(), ref.Repository, digest)
+			if !deleteOpts.yes && !confirm(fmt.Sprintf("delete %s (all tags pointing to this digest are removed)? [y/N] ", target)) {
+				fmt.Println("canceled")
+				return
+			}
+			if err := imagePush.DeleteManifest(ctx, ref.Repository, digest); err != nil {
+				log.Fatalf("delete %s: %v", target, err)
+			}
+			fmt.Printf("deleted %s\n", target)
+		},
+	}
+)
+
+// confirm 在终端上确认，输入 y 或者 yes 才继续
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	deleteOpts.addFlags(DeleteCmd.Flags())
+	DeleteCmd.Flags().BoolVarP(&deleteOpts.yes, "yes", "y", false, "delete without confirmation")
+}
@@ -1,7 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
 
 	"github.com/silenceper/log"
 	"github.com/spf13/cobra"
@@ -14,6 +22,14 @@ var (
 	imagePrefix   string
 	skipSSLVerify bool
 	logLevel      int
+	maxBandwidth  string
+	uploadMethod  string
+	chunkSize     string
+	tag           string
+	extraTags     string
+	digestOnly    bool
+	lockFile      string
+	lockFormat    string
 
 	DockerTarPushCmd = &cobra.Command{
 		Use:   "docker-tar-push",
@@ -22,8 +38,49 @@ var (
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			log.SetLogLevel(log.Level(logLevel))
+			// Ctrl+C 时中断推送，并删除仓库上未完成的上传
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 			imagePush := push.NewImagePush(args[0], registryURL, imagePrefix, username, password, skipSSLVerify, nil)
-			imagePush.Push()
+			limit, err := util.ParseSize(maxBandwidth)
+			if err != nil {
+				log.Fatalf("invalid max-bandwidth: %v", err)
+			}
+			imagePush.SetRateLimiters(util.NewRateLimiter(limit))
+			strategy, err := push.ParseUploadStrategy(uploadMethod)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			size, err := util.ParseSize(chunkSize)
+			if err != nil {
+				log.Fatalf("invalid upload-chunk-size: %v", err)
+			}
+			imagePush.SetUploadStrategy(strategy, size)
+			ref, err := push.ParseTag(tag)
+			if err != nil {
+				log.Fatalf("invalid tag: %v", err)
+			}
+			imagePush.SetTag(ref)
+			tags, err := util.ParseTags(extraTags)
+			if err != nil {
+				log.Fatalf("invalid extra-tags: %v", err)
+			}
+			if digestOnly && len(tags) > 0 {
+				log.Fatalf("--extra-tags can not be used with --digest-only")
+			}
+			imagePush.SetExtraTags(tags)
+			imagePush.SetDigestOnly(digestOnly)
+			format, err := push.ParseLockFormat(lockFormat, lockFile)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			imagePush.Push(ctx)
+			if lockFile != "" {
+				if err := writeLockFile(lockFile, format, imagePush.Registry(), imagePush.Results()); err != nil {
+					log.Fatalf("%v", err)
+				}
+				log.Infof("digest lock file written to %s", lockFile)
+			}
 		},
 	}
 )
@@ -34,7 +91,33 @@ func init() {
 	DockerTarPushCmd.Flags().StringVar(&password, "password", "", "registry auth password")
 	DockerTarPushCmd.Flags().StringVar(&imagePrefix, "image-prefix", "", "add image repo prefix")
 	DockerTarPushCmd.Flags().BoolVar(&skipSSLVerify, "skip-ssl-verify", true, "skip ssl verify")
+	DockerTarPushCmd.Flags().StringVar(&maxBandwidth, "max-bandwidth", "0", "upload bandwidth per second, e.g. 10M, 0 means unlimited")
+	DockerTarPushCmd.Flags().StringVar(&uploadMethod, "upload-strategy", string(push.UploadAuto), "how blobs are uploaded: auto, chunked, stream, monolithic")
+	DockerTarPushCmd.Flags().StringVar(&chunkSize, "upload-chunk-size", "2M", "size of each PATCH when uploading blobs in chunks")
+	DockerTarPushCmd.Flags().StringVar(&tag, "tag", "", "push with this tag instead of the tags in the archive, name:tag also sets the image name (required for untagged archives)")
+	DockerTarPushCmd.Flags().StringVar(&extraTags, "extra-tags", "", "also tag every pushed image with these tags without re-uploading, e.g. latest,stable")
+	DockerTarPushCmd.Flags().BoolVar(&digestOnly, "digest-only", false, "push manifests by digest only, without any tag")
+	DockerTarPushCmd.Flags().StringVar(&lockFile, "lock-file", "", "write the pushed digests to this file, e.g. images.lock.yaml")
+	DockerTarPushCmd.Flags().StringVar(&lockFormat, "lock-format", "", "format of the lock file: json, yaml or kustomize, defaults to the file extension")
 	DockerTarPushCmd.Flags().IntVar(&logLevel, "log-level", log.LevelInfo, "log-level, 0:Fatal,1:Error,2:Warn,3:Info,4:Debug")
 
 	DockerTarPushCmd.MarkFlagRequired("registry")
 }
+
+// writeLockFile 写 digest 锁定文件，有镜像推送失败时不写，避免部署时固定到不完整的结果
+func writeLockFile(file string, format push.LockFormat, registry string, results []push.Result) error {
+	for _, result := range results {
+		if result.Error != "" {
+			return errors.New("some images failed to push, lock file is not written")
+		}
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := push.NewLock(registry, results).Write(f, format); err != nil {
+		f.Close()
+		return fmt.Errorf("write lock file %s: %v", file, err)
+	}
+	return f.Close()
+}
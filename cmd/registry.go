@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/spf13/pflag"
+)
+
+// registryOptions 直接访问镜像仓库的命令（check、delete 等）共用的参数
+type registryOptions struct {
+	registry      string
+	username      string
+	password      string
+	caCert        string
+	skipSSLVerify bool
+}
+
+func (o *registryOptions) addFlags(f *pflag.FlagSet) {
+	f.StringVar(&o.registry, "registry", "", "registry url, can be omitted when the image reference contains the registry")
+	f.StringVar(&o.username, "username", "", "registry auth username")
+	f.StringVar(&o.password, "password", "", "registry auth password")
+	f.StringVar(&o.caCert, "ca-cert", "", "ca certificate file of the registry")
+	f.BoolVar(&o.skipSSLVerify, "skip-ssl-verify", false, "skip ssl verify")
+}
+
+// client 访问镜像仓库的客户端，ref 带有仓库地址时可以不指定 --registry
+func (o *registryOptions) client(ref *util.Reference) (*push.ImagePush, error) {
+	registry := o.registry
+	if registry == "" && ref != nil {
+		registry = ref.Registry
+	}
+	if registry == "" {
+		return nil, fmt.Errorf("--registry is required")
+	}
+	imagePush := push.NewImagePush("", registry, "", o.username, o.password, o.skipSSLVerify, nil)
+	if ref != nil && ref.Registry != "" {
+		if u, err := url.Parse(imagePush.Registry()); err != nil || u.Host != ref.Registry {
+			return nil, fmt.Errorf("registry %s of %s does not match --registry %s", ref.Registry, ref, o.registry)
+		}
+	}
+	if o.caCert != "" {
+		data, err := os.ReadFile(o.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("read ca certificate: %v", err)
+		}
+		if err := imagePush.SetCACert(data); err != nil {
+			return nil, err
+		}
+	}
+	return imagePush, nil
+}
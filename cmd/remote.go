@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"docker-tar-push-ui/pkg/client"
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	remoteOpts      client.Options
+	remoteChunkSize string
+	remotePush      client.PushRequest
+	remoteNoUpload  bool
+	remoteDetach    bool
+	remoteFollow    bool
+	remoteLimitJob  string
+	remoteLockFile  string
+	remoteLockFmt   string
+
+	// RemoteCmd 通过接口使用远程的 docker-tar-push-ui 服务，适合在构建机上把镜像包发送到中心服务推送
+	RemoteCmd = &cobra.Command{
+		Use:   "remote",
+		Short: "upload archives to and push them from a remote docker-tar-push-ui server",
+		Long: `upload archives to and push them from a remote docker-tar-push-ui server.
+
+The server address and api token can also be set with env DTP_SERVER and DTP_TOKEN.`,
+		// 参数解析通过后的错误（例如推送失败）不需要打印用法
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			cmd.SilenceUsage = true
+		},
+	}
+
+	remoteUploadCmd = &cobra.Command{
+		Use:   "upload <file>",
+		Short: "upload an archive (resumable, an interrupted upload continues where it stopped)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := remoteClient()
+			if err != nil {
+				return err
+			}
+			result, err := remoteUpload(c, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s sha256:%s\n", result.Filename, result.Sha256)
+			return nil
+		},
+	}
+
+	remotePushCmd = &cobra.Command{
+		Use:   "push <file>",
+		Short: "upload an archive and push it, exits non-zero when the push fails",
+		Long: `upload an archive and push it, exits non-zero when the push fails.
+
+Use --profile to push with a registry profile saved on the server, or --registry,
+--username and --password. Use --no-upload when the archive is already on the server.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := remoteClient()
+			if err != nil {
+				return err
+			}
+			req := remotePush
+			req.Archive = args[0]
+			if !remoteNoUpload {
+				result, err := remoteUpload(c, args[0])
+				if err != nil {
+					return err
+				}
+				req.Archive = result.Filename
+			}
+			format, err := push.ParseLockFormat(remoteLockFmt, remoteLockFile)
+			if err != nil {
+				return err
+			}
+			job, err := c.CreatePush(req)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "push job %s created\n", job.ID)
+			if remoteDetach {
+				fmt.Println(job.ID)
+				return nil
+			}
+			if job, err = followJob(c, job.ID); err != nil || remoteLockFile == "" {
+				return err
+			}
+			if err := writeLockFile(remoteLockFile, format, job.Registry, job.Results); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "digest lock file written to %s\n", remoteLockFile)
+			return nil
+		},
+	}
+
+	remoteJobsCmd = &cobra.Command{
+		Use:   "jobs",
+		Short: "list push jobs of the workspace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := remoteClient()
+			if err != nil {
+				return err
+			}
+			jobs, err := c.Jobs()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tSTATUS\tARCHIVE\tREGISTRY\tPREFIX\tUSER\tCREATED")
+			for _, job := range jobs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Status, job.Archive, job.Registry, job.Prefix, job.User, job.CreatedAt.Local().Format(time.DateTime))
+			}
+			return w.Flush()
+		},
+	}
+
+	remoteLogsCmd = &cobra.Command{
+		Use:   "logs <id>",
+		Short: "print the logs of a push job, -f follows until the job finishes",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := remoteClient()
+			if err != nil {
+				return err
+			}
+			if remoteFollow {
+				_, err := followJob(c, args[0])
+				return err
+			}
+			data, _, _, err := c.Logs(args[0], 0)
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(data)
+			return nil
+		},
+	}
+
+	remoteLimitCmd = &cobra.Command{
+		Use:   "limit <rate>",
+		Short: "change the upload bandwidth of a running push job (--job) or of the whole server, e.g. 10M, 0 means unlimited",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := remoteClient()
+			if err != nil {
+				return err
+			}
+			if remoteLimitJob != "" {
+				job, err := c.SetBandwidth(remoteLimitJob, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("push job %s bandwidth: %s\n", job.ID, util.FormatRate(job.MaxBandwidth))
+				return nil
+			}
+			limit, err := c.SetGlobalBandwidth(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("server bandwidth: %s\n", util.FormatRate(limit))
+			return nil
+		},
+	}
+)
+
+func remoteClient() (*client.Client, error) {
+	opts := remoteOpts
+	if opts.Server == "" {
+		opts.Server = os.Getenv("DTP_SERVER")
+	}
+	if opts.Token == "" {
+		opts.Token = os.Getenv("DTP_TOKEN")
+	}
+	return client.New(opts)
+}
+
+// remoteUpload 上传文件，进度打印到标准错误
+func remoteUpload(c *client.Client, file string) (*client.UploadResult, error) {
+	chunkSize, err := util.ParseSize(remoteChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(file)
+	fmt.Fprintf(os.Stderr, "calculating sha256 of %s ...\n", name)
+	result, err := c.Upload(file, chunkSize, func(done, total int64) {
+		percent := 100.0
+		if total > 0 {
+			percent = float64(done) * 100 / float64(total)
+		}
+		fmt.Fprintf(os.Stderr, "\ruploading %s %s/%s %.2f%%", name, util.FormatSize(done), util.FormatSize(total), percent)
+	})
+	fmt.Fprintln(os.Stderr)
+	return result, err
+}
+
+// followJob 持续打印任务日志直到结束，任务没有成功时返回错误
+func followJob(c *client.Client, id string) (*client.Job, error) {
+	job, err := c.FollowLogs(id, os.Stdout, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range job.Results {
+		image := result.Repository
+		if result.Tag != "" {
+			image += ":" + result.Tag
+		}
+		if result.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", result.Archive, image, result.Error)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s@%s\n", image, result.Digest)
+	}
+	if job.Status != "succeeded" {
+		return job, fmt.Errorf("push job %s %s", job.ID, job.Status)
+	}
+	return job, nil
+}
+
+func init() {
+	f := RemoteCmd.PersistentFlags()
+	f.StringVar(&remoteOpts.Server, "server", "", "address of the docker-tar-push-ui server, e.g. https://dtp.example.com (env DTP_SERVER)")
+	f.StringVar(&remoteOpts.Token, "token", "", "api token (env DTP_TOKEN)")
+	f.StringVar(&remoteOpts.Workspace, "workspace", "", "workspace on the server")
+	f.BoolVar(&remoteOpts.SkipSSLVerify, "insecure", false, "skip verifying the server certificate")
+	f.StringVar(&remoteOpts.CACert, "ca-cert", "", "ca certificate of the server")
+	f.StringVar(&remoteOpts.ClientCert, "client-cert", "", "client certificate, when the server requires one")
+	f.StringVar(&remoteOpts.ClientKey, "client-key", "", "client private key")
+
+	for _, cmd := range []*cobra.Command{remoteUploadCmd, remotePushCmd} {
+		cmd.Flags().StringVar(&remoteChunkSize, "chunk-size", "8M", "size of each uploaded chunk")
+	}
+	pf := remotePushCmd.Flags()
+	pf.StringVar(&remotePush.Profile, "profile", "", "registry profile saved on the server")
+	pf.StringVar(&remotePush.Endpoint, "registry", "", "registry url, when not using a profile")
+	pf.StringVar(&remotePush.Prefix, "prefix", "", "image prefix (project), overrides the prefix of the profile")
+	pf.StringVar(&remotePush.Username, "username", "", "registry username")
+	pf.StringVar(&remotePush.Password, "password", "", "registry password")
+	pf.BoolVar(&remotePush.SkipSSLVerify, "skip-ssl-verify", false, "skip verifying the registry certificate")
+	pf.StringVar(&remotePush.MaxBandwidth, "max-bandwidth", "", "upload bandwidth of the push job per second, e.g. 10M")
+	pf.StringVar(&remotePush.UploadStrategy, "upload-strategy", "", "how the server uploads blobs to the registry: auto, chunked, stream, monolithic")
+	pf.StringVar(&remotePush.UploadChunkSize, "upload-chunk-size", "", "size of each PATCH when the server uploads blobs to the registry in chunks")
+	pf.StringVar(&remotePush.Tag, "tag", "", "push with this tag instead of the tags in the archive, name:tag also sets the image name")
+	pf.StringVar(&remotePush.ExtraTags, "extra-tags", "", "also tag every pushed image with these tags without re-uploading, e.g. latest,stable")
+	pf.BoolVar(&remotePush.DigestOnly, "digest-only", false, "push manifests by digest only, without any tag")
+	pf.StringVar(&remoteLockFile, "lock-file", "", "write the pushed digests to this file when the push succeeds, e.g. images.lock.yaml")
+	pf.StringVar(&remoteLockFmt, "lock-format", "", "format of the lock file: json, yaml or kustomize, defaults to the file extension")
+	pf.BoolVar(&remoteNoUpload, "no-upload", false, "the archive is already on the server, only push it")
+	pf.BoolVarP(&remoteDetach, "detach", "d", false, "print the job id and exit without waiting for the push")
+	remoteLimitCmd.Flags().StringVar(&remoteLimitJob, "job", "", "id of the push job, changes the bandwidth of the whole server (admin) if empty")
+	remoteLogsCmd.Flags().BoolVarP(&remoteFollow, "follow", "f", false, "follow the logs until the job finishes, exits non-zero when the push fails")
+
+	RemoteCmd.AddCommand(remoteUploadCmd, remotePushCmd, remoteJobsCmd, remoteLogsCmd, remoteLimitCmd)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/silenceper/log"
 	"github.com/spf13/cobra"
 )
 
@@ -35,14 +36,19 @@ func init() {
 	RootCmd.AddCommand(VersionCmd)
 	RootCmd.AddCommand(ServerCmd)
 	RootCmd.AddCommand(DockerTarPushCmd)
+	RootCmd.AddCommand(SplitCmd)
+	RootCmd.AddCommand(AuthCmd)
+	RootCmd.AddCommand(RemoteCmd)
+	RootCmd.AddCommand(CheckCmd)
+	RootCmd.AddCommand(DeleteCmd)
+	RootCmd.AddCommand(TagCmd)
 	// 在RootCmd Excute前，version这些都还只是初始值
 }
 
 // OutAlistInit 暴露用于外部启动server的函数
 func OutAlistInit() {
-	var (
-		cmd  *cobra.Command
-		args []string
-	)
-	ServerCmd.Run(cmd, args)
+	var args []string
+	if err := ServerCmd.RunE(ServerCmd, args); err != nil {
+		log.Fatalf("%v", err)
+	}
 }
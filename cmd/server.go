@@ -1,22 +1,152 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"time"
+
+	"docker-tar-push-ui/pkg/config"
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
 	"docker-tar-push-ui/web"
 
+	"github.com/silenceper/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var port string
+var configFile string
 
 // VersionCmd represents the version command
 var ServerCmd = &cobra.Command{
 	Use:   "server",
 	Short: "启动web服务",
-	Run: func(cmd *cobra.Command, args []string) {
-		web.Server(port)
+	Long: `启动web服务
+
+配置的优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+环境变量为 DTP_ 加上大写的参数名，例如 --upload-dir 对应 DTP_UPLOAD_DIR`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configFile == "" {
+			configFile = os.Getenv("DTP_CONFIG")
+		}
+		cfg, err := config.Load(configFile)
+		if err != nil {
+			return err
+		}
+		// 只有显式指定的命令行参数才覆盖配置文件和环境变量
+		cmd.Flags().Visit(func(f *pflag.Flag) {
+			key := f.Name
+			switch key {
+			case "config":
+				return
+			case "port":
+				key = "listen"
+			}
+			if err == nil {
+				err = cfg.Set(key, f.Value.String())
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		opts, err := serverOptions(cfg)
+		if err != nil {
+			return err
+		}
+		log.Infof("effective config:\n%s", cfg)
+		web.Server(opts)
+		return nil
 	},
 }
 
+// serverOptions 把配置转换成 web 服务的启动参数，相对路径基于 root 目录
+func serverOptions(cfg *config.Config) (web.Options, error) {
+	opts := web.Options{
+		Listen:          cfg.Listen,
+		UploadDir:       cfg.Path(cfg.UploadDir),
+		TmpDir:          cfg.Path(cfg.TmpDir),
+		JobConcurrency:  cfg.JobConcurrency,
+		DefaultProfile:  cfg.DefaultProfile,
+		AuthConfig:      cfg.Path(cfg.AuthConfig),
+		ProfilesFile:    cfg.Path(cfg.ProfilesFile),
+		MasterKeyFile:   cfg.Path(cfg.MasterKeyFile),
+		AuditLog:        cfg.Path(cfg.AuditLog),
+		AuditMaxBackups: cfg.AuditMaxBackups,
+		MetricsPublic:   cfg.MetricsPublic,
+		TLSCert:         cfg.Path(cfg.TLS.CertFile),
+		TLSKey:          cfg.Path(cfg.TLS.KeyFile),
+		TLSSelfSigned:   cfg.TLS.SelfSigned,
+		TLSClientCA:     cfg.Path(cfg.TLS.ClientCAFile),
+	}
+	var err error
+	if opts.MaxUploadSize, err = util.ParseSize(cfg.MaxUploadSize); err != nil {
+		return opts, err
+	}
+	if opts.AuditMaxSize, err = util.ParseSize(cfg.AuditMaxSize); err != nil {
+		return opts, err
+	}
+	minFreeDisk, err := util.ParseSize(cfg.MinFreeDisk)
+	if err != nil {
+		return opts, err
+	}
+	opts.MinFreeDisk = uint64(minFreeDisk)
+	if opts.MaxBandwidth, err = util.ParseSize(cfg.MaxBandwidth); err != nil {
+		return opts, err
+	}
+	if opts.UploadStrategy, err = push.ParseUploadStrategy(cfg.UploadStrategy); err != nil {
+		return opts, err
+	}
+	if opts.UploadChunkSize, err = util.ParseSize(cfg.UploadChunkSize); err != nil {
+		return opts, err
+	}
+	if opts.ShutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout); err != nil {
+		return opts, err
+	}
+	if opts.LogLevel, err = config.ParseLogLevel(cfg.LogLevel); err != nil {
+		return opts, err
+	}
+	if flag {
+		opts.LogLevel = log.LevelDebug
+	}
+	return opts, nil
+}
+
 func init() {
-	ServerCmd.Flags().StringVar(&port, "port", "8088", "server port")
+	d := config.Default()
+	f := ServerCmd.Flags()
+	f.StringVarP(&configFile, "config", "c", "", "config file (yaml), or env DTP_CONFIG")
+	f.String("listen", d.Listen, "listen address")
+	f.String("port", "", "server port, same as --listen :PORT")
+	f.String("root", d.Root, "base directory of relative paths (env ROOT is also supported)")
+	f.String("upload-dir", d.UploadDir, "directory of uploaded archives")
+	f.String("tmp-dir", d.TmpDir, "directory to extract archives when pushing (env TMP_DIR is also supported)")
+	f.String("max-upload-size", d.MaxUploadSize, "max size of an uploaded file, 0 means unlimited")
+	f.Int("job-concurrency", d.JobConcurrency, "max number of pushes running at the same time")
+	f.String("default-profile", d.DefaultProfile, "registry profile used when the push command does not specify a registry")
+	f.String("log-level", d.LogLevel, "log level: fatal, error, warn, info, debug")
+	f.String("auth-config", d.AuthConfig, "auth config file (users, api tokens, oidc), authentication is disabled if empty")
+	f.String("profiles-file", d.ProfilesFile, "registry profiles file")
+	f.String("master-key-file", d.MasterKeyFile, "file of the master key used to encrypt profile passwords (or env DTP_MASTER_KEY / DTP_MASTER_KEY_FILE)")
+	f.String("audit-log", d.AuditLog, "audit log file (json lines), disabled if empty")
+	f.String("audit-max-size", d.AuditMaxSize, "rotate the audit log when it grows larger than this size")
+	f.Int("audit-max-backups", d.AuditMaxBackups, "number of rotated audit log files to keep, 0 disables rotation")
+	f.String("shutdown-timeout", d.ShutdownTimeout, "how long to wait for running pushes on SIGTERM before stopping them")
+	f.String("min-free-disk", d.MinFreeDisk, "readiness fails when free disk space is below this size")
+	f.String("max-bandwidth", d.MaxBandwidth, "total upload bandwidth of all pushes per second, e.g. 10M, 0 means unlimited")
+	f.String("upload-strategy", d.UploadStrategy, "how blobs are uploaded to the registry: auto, chunked, stream, monolithic")
+	f.String("upload-chunk-size", d.UploadChunkSize, "size of each PATCH when uploading blobs in chunks")
+	f.Bool("metrics-public", d.MetricsPublic, "serve /metrics without authentication when auth is enabled")
+	f.String("tls-cert", d.TLS.CertFile, "tls certificate file, serve https when set")
+	f.String("tls-key", d.TLS.KeyFile, "tls private key file")
+	f.Bool("tls-self-signed", d.TLS.SelfSigned, "generate a self-signed certificate if the certificate files do not exist (default ./data/tls.crt, ./data/tls.key)")
+	f.String("tls-client-ca", d.TLS.ClientCAFile, "require client certificates signed by this CA")
+	// 确保每个配置项都有对应的命令行参数
+	for _, key := range config.Keys {
+		if f.Lookup(key) == nil {
+			panic(fmt.Sprintf("missing flag for config key %s", key))
+		}
+	}
 }
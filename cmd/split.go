@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	splitSize    string
+	splitOutDir  string
+	splitNumeric bool
+
+	// SplitCmd 把大的镜像包切分成分卷，方便通过有文件大小限制的介质传输
+	SplitCmd = &cobra.Command{
+		Use:   "split <archive>",
+		Short: "split a large docker tar archive into parts",
+		Long: `split a large docker tar archive into parts (images.tar.part-aa, images.tar.part-ab ... or images.tar.001, images.tar.002 ...)
+and write a images.tar.sha256 checksum file, the parts can be pushed directly.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := util.ParseSize(splitSize)
+			if err != nil {
+				return err
+			}
+			parts, err := util.SplitFile(args[0], splitOutDir, size, splitNumeric)
+			if err != nil {
+				return err
+			}
+			for _, part := range parts {
+				fmt.Println(part)
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	SplitCmd.Flags().StringVar(&splitSize, "size", "1G", "max size of each part, e.g. 500M, 1G")
+	SplitCmd.Flags().StringVar(&splitOutDir, "out", "", "output directory, defaults to the directory of the archive")
+	SplitCmd.Flags().BoolVar(&splitNumeric, "numeric", false, "use numeric suffixes (.001) instead of .part-aa")
+}
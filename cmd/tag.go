@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/silenceper/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tagOpts struct {
+		registryOptions
+	}
+
+	TagCmd = &cobra.Command{
+		Use:   "tag <image:tag|image@digest> <new-tag>...",
+		Short: "add tags to an image in the registry without re-uploading",
+		Long: `add tags to an image in the registry without re-uploading.
+
+The manifest is fetched once and put under each new tag, layers are not downloaded or uploaded.
+A new tag can be a tag in the same repository (stable) or another repository in the same registry (team/app:1.0),
+blobs are mounted across repositories in that case.`,
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			source, err := util.ParseReference(args[0])
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			if source.Reference() == "" {
+				log.Fatalf("tag or digest is required, e.g. %s:1.0", source)
+			}
+			imagePush, err := tagOpts.client(source)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			targets := make([]*util.Reference, 0, len(args)-1)
+			for _, arg := range args[1:] {
+				target, err := util.ParseTagTarget(source, arg)
+				if err != nil {
+					log.Fatalf("%v", err)
+				}
+				// 只能在同一个仓库地址内加 tag
+				if target.Registry != "" && target.Registry != source.Registry {
+					if source.Registry != "" {
+						log.Fatalf("%s: can not tag across registries (%s)", arg, source.Registry)
+					}
+					if _, err := tagOpts.client(target); err != nil {
+						log.Fatalf("%s: %v", arg, err)
+					}
+				}
+				targets = append(targets, target)
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			digest, err := imagePush.Tag(ctx, source, targets)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			for _, target := range targets {
+				fmt.Printf("tagged %s/%s:%s@%s\n", imagePush.Registry(), target.Repository, target.Tag, digest)
+			}
+		},
+	}
+)
+
+func init() {
+	tagOpts.addFlags(TagCmd.Flags())
+}
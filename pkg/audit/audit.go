@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/silenceper/log"
+)
+
+// 审计的操作
+const (
+	ActionUpload = "upload"
+	ActionDelete = "delete"
+	ActionPush   = "push"
+)
+
+// 操作结果
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultDenied  = "denied"
+)
+
+// Event 一条审计记录
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Result     string    `json:"result"`
+	User       string    `json:"user,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Workspace  string    `json:"workspace,omitempty"`
+	Archive    string    `json:"archive,omitempty"`
+	Sha256     string    `json:"sha256,omitempty"` // 镜像包的 sha256
+	Size       int64     `json:"size,omitempty"`
+	Registry   string    `json:"registry,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest,omitempty"` // 推送的 manifest digest
+	Error      string    `json:"error,omitempty"`
+}
+
+// Filter 查询条件，为空的字段不过滤
+type Filter struct {
+	Action string
+	User   string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f *Filter) match(e *Event) bool {
+	return (f.Action == "" || f.Action == e.Action) &&
+		(f.User == "" || f.User == e.User) &&
+		(f.Result == "" || f.Result == e.Result) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Logger 追加写入的 JSON lines 审计日志，超过 maxSize 后轮转为 file.1、file.2 ...
+type Logger struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// New 打开审计日志，maxSize <= 0 或者 maxBackups <= 0 时不轮转，审计日志不会被删除
+func New(file string, maxSize int64, maxBackups int) (*Logger, error) {
+	l := &Logger{file: file, maxSize: maxSize, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Record 写入一条记录，写入失败只打日志，不影响业务
+func (l *Logger) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("marshal audit event failed: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.maxBackups > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Errorf("rotate audit log failed: %v", err)
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			log.Errorf("open audit log failed: %v", err)
+			return
+		}
+	}
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Errorf("write audit log failed: %v", err)
+	}
+}
+
+func (l *Logger) rotate() error {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	os.Remove(l.backup(l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		if _, err := os.Stat(l.backup(i)); err == nil {
+			if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(l.file, l.backup(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Logger) backup(i int) string {
+	return fmt.Sprintf("%s.%d", l.file, i)
+}
+
+// Query 按条件查询，包括轮转后的文件，最新的记录在前
+func (l *Logger) Query(filter Filter) ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	files := []string{l.file}
+	for i := 1; i <= l.maxBackups; i++ {
+		files = append(files, l.backup(i))
+	}
+	var events []Event
+	for _, file := range files {
+		batch, err := readEvents(file, &filter)
+		if err != nil {
+			return nil, err
+		}
+		// 每个文件内部是按时间顺序写入的，倒序后拼接
+		for i := len(batch) - 1; i >= 0; i-- {
+			events = append(events, batch[i])
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				return events, nil
+			}
+		}
+	}
+	return events, nil
+}
+
+func readEvents(file string, filter *Filter) ([]Event, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if filter.match(&e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Close 关闭日志文件
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// RoleAdmin 管理员角色，可以查看和管理所有工作空间
+const RoleAdmin = "admin"
+
+// Config 认证配置文件
+//
+//	sessionTTL: 12h
+//	allowedOrigins: ["https://upload.example.com"]
+//	users:
+//	  - username: admin
+//	    passwordHash: $2a$10$...   # docker-tar-push-ui auth hash-password 生成
+//	    roles: [admin]
+//	tokens:
+//	  - name: ci
+//	    username: ci-bot
+//	    tokenHash: 9f86d0...       # docker-tar-push-ui auth token 生成
+//	    roles: [push]
+//	oidc:
+//	  issuer: http://localhost:8080/default
+//	  clientID: docker-tar-push-ui
+//	  clientSecret: secret
+//	  redirectURL: http://localhost:8088/auth/oidc/callback
+type Config struct {
+	SessionTTL     time.Duration `yaml:"sessionTTL"`
+	AllowedOrigins []string      `yaml:"allowedOrigins"`
+	Users          []User        `yaml:"users"`
+	Tokens         []Token       `yaml:"tokens"`
+	OIDC           *OIDCConfig   `yaml:"oidc"`
+	Roles          []Role        `yaml:"roles"`
+}
+
+// User 本地用户
+type User struct {
+	Username     string   `yaml:"username"`
+	PasswordHash string   `yaml:"passwordHash"` // bcrypt
+	Roles        []string `yaml:"roles"`
+	Workspace    string   `yaml:"workspace"` // 不填时使用用户名
+}
+
+// Token API Token，给脚本和命令行使用
+type Token struct {
+	Name      string   `yaml:"name"`
+	Username  string   `yaml:"username"`
+	TokenHash string   `yaml:"tokenHash"` // sha256 十六进制
+	Roles     []string `yaml:"roles"`
+	Workspace string   `yaml:"workspace"`
+}
+
+// Identity 认证通过的用户身份
+type Identity struct {
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles"`
+	Workspace string   `json:"workspace,omitempty"`
+	Method    string   `json:"method"` // password/token/oidc
+}
+
+// HasRole 是否拥有某个角色
+func (id *Identity) HasRole(role string) bool {
+	if id == nil {
+		return false
+	}
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin 是否是管理员
+func (id *Identity) IsAdmin() bool {
+	return id.HasRole(RoleAdmin)
+}
+
+// LoadConfig 读取认证配置文件
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse auth config %s failed: %w", file, err)
+	}
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 12 * time.Hour
+	}
+	for _, u := range cfg.Users {
+		if u.Username == "" || u.PasswordHash == "" {
+			return nil, fmt.Errorf("auth config %s: user must have username and passwordHash", file)
+		}
+	}
+	for _, t := range cfg.Tokens {
+		if t.Username == "" || len(t.TokenHash) != sha256.Size*2 {
+			return nil, fmt.Errorf("auth config %s: token %q must have username and a sha256 tokenHash", file, t.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// HashPassword 生成 bcrypt 密码哈希
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// HashToken API Token 只保存 sha256
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken 生成随机的 API Token
+func NewToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "dtp_" + hex.EncodeToString(b)
+}
+
+// Authenticate 校验本地用户的账号密码
+func (cfg *Config) Authenticate(username, password string) (*Identity, bool) {
+	for _, u := range cfg.Users {
+		if u.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return nil, false
+		}
+		return &Identity{Username: u.Username, Roles: u.Roles, Workspace: u.Workspace, Method: "password"}, true
+	}
+	// 用户不存在时也做一次比较，避免通过响应时间判断用户是否存在
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return nil, false
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// AuthenticateToken 校验 API Token
+func (cfg *Config) AuthenticateToken(token string) (*Identity, bool) {
+	hash := HashToken(token)
+	for _, t := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.TokenHash)) == 1 {
+			return &Identity{Username: t.Username, Roles: t.Roles, Workspace: t.Workspace, Method: "token"}, true
+		}
+	}
+	return nil, false
+}
+
+// Sessions 登录会话，只保存在内存中，服务重启后需要重新登录
+type Sessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*session
+}
+
+type session struct {
+	identity *Identity
+	expires  time.Time
+}
+
+// NewSessions new
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{ttl: ttl, sessions: map[string]*session{}}
+}
+
+// Create 创建会话，返回会话 ID
+func (s *Sessions) Create(identity *Identity) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// 顺便清理过期的会话
+	for k, v := range s.sessions {
+		if now.After(v.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = &session{identity: identity, expires: now.Add(s.ttl)}
+	return id
+}
+
+// Get 查询会话
+func (s *Sessions) Get(id string) (*Identity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.sessions[id]
+	if !ok || time.Now().After(v.expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return v.identity, true
+}
+
+// Delete 退出登录
+func (s *Sessions) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// TTL 会话有效期
+func (s *Sessions) TTL() time.Duration {
+	return s.ttl
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig OIDC 登录配置，issuer 可以是本地的 mock 服务（例如 http://localhost:8080/default）
+type OIDCConfig struct {
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"clientID"`
+	ClientSecret  string   `yaml:"clientSecret"`
+	RedirectURL   string   `yaml:"redirectURL"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"usernameClaim"` // 默认 preferred_username，没有时使用 email、sub
+	RolesClaim    string   `yaml:"rolesClaim"`    // 例如 groups，取出的值作为角色
+	Roles         []string `yaml:"roles"`         // 所有 OIDC 用户默认拥有的角色
+}
+
+// OIDC 授权码模式登录
+type OIDC struct {
+	cfg *OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// NewOIDC new，issuer 在第一次登录时才会去发现，启动时 issuer 不可用不影响服务启动
+func NewOIDC(cfg *OIDCConfig) *OIDC {
+	return &OIDC{cfg: cfg}
+}
+
+func (o *OIDC) init(ctx context.Context) (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover oidc issuer %s failed: %w", o.cfg.Issuer, err)
+	}
+	o.provider = provider
+	return provider, nil
+}
+
+func (o *OIDC) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := o.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     o.cfg.ClientID,
+		ClientSecret: o.cfg.ClientSecret,
+		RedirectURL:  o.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// AuthCodeURL 跳转到 issuer 登录的地址
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	provider, err := o.init(ctx)
+	if err != nil {
+		return "", err
+	}
+	return o.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange 用授权码换取并校验 id_token，返回用户身份
+func (o *OIDC) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	provider, err := o.init(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := o.oauth2Config(provider).Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code failed: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("id_token is missing in token response")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.cfg.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verify id_token failed: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("id_token nonce mismatch")
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Method: "oidc", Roles: append([]string{}, o.cfg.Roles...)}
+	for _, claim := range []string{o.cfg.UsernameClaim, "preferred_username", "email", "sub"} {
+		if v, ok := claims[claim].(string); ok && claim != "" && v != "" {
+			identity.Username = v
+			break
+		}
+	}
+	if o.cfg.RolesClaim != "" {
+		switch v := claims[o.cfg.RolesClaim].(type) {
+		case []interface{}:
+			for _, role := range v {
+				if r, ok := role.(string); ok {
+					identity.Roles = append(identity.Roles, r)
+				}
+			}
+		case string:
+			identity.Roles = append(identity.Roles, v)
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 权限控制的操作
+const (
+	ActionUpload = "upload" // 上传镜像包
+	ActionPush   = "push"   // 推送镜像
+	ActionDelete = "delete" // 删除上传的镜像包、删除仓库里的镜像
+)
+
+// ErrForbidden 没有权限
+var ErrForbidden = errors.New("forbidden")
+
+// Role 角色，限制可以执行的操作、可以推送的镜像仓库和仓库路径
+//
+//	roles:
+//	  - name: team-a
+//	    actions: [upload, push]
+//	    registries: ["harbor.internal"]
+//	    repositories: ["team-a/*"]
+//
+// registries 和 repositories 支持通配符，team-a/* 可以匹配 team-a 下任意层级的仓库；
+// admin 角色拥有所有权限；删除镜像包和仓库里的镜像需要 admin 或者包含 delete 操作的角色；
+// 没有配置任何角色时，登录用户可以上传和推送到任意仓库
+type Role struct {
+	Name         string   `yaml:"name"`
+	Actions      []string `yaml:"actions"`
+	Registries   []string `yaml:"registries"`
+	Repositories []string `yaml:"repositories"`
+}
+
+// Authorize 检查用户是否可以对 registry/repository 执行操作，registry 和 repository 为空时不检查
+func (cfg *Config) Authorize(identity *Identity, action, registry, repository string) error {
+	return cfg.authorize(identity, action, registry, repository, false)
+}
+
+// AuthorizePrefix 检查用户是否可以推送到 registry 的 prefix 下，用于在解析镜像包之前提前检查
+func (cfg *Config) AuthorizePrefix(identity *Identity, action, registry, prefix string) error {
+	return cfg.authorize(identity, action, registry, prefix, true)
+}
+
+func (cfg *Config) authorize(identity *Identity, action, registry, repository string, prefixOnly bool) error {
+	if identity == nil {
+		return fmt.Errorf("%w: not logged in", ErrForbidden)
+	}
+	if identity.IsAdmin() {
+		return nil
+	}
+	// 没有配置角色时只限制删除
+	if len(cfg.Roles) == 0 && action != ActionDelete {
+		return nil
+	}
+	host := registryHost(registry)
+	for _, role := range cfg.Roles {
+		if !identity.HasRole(role.Name) || !contains(role.Actions, action) {
+			continue
+		}
+		if registry != "" && !matchAny(role.Registries, func(p string) bool { return matchRegistry(p, host) }) {
+			continue
+		}
+		if repository != "" && !prefixOnly && !matchAny(role.Repositories, func(p string) bool { return matchRepository(p, repository) }) {
+			continue
+		}
+		if repository != "" && prefixOnly && !matchAny(role.Repositories, func(p string) bool { return matchRepositoryPrefix(p, repository) }) {
+			continue
+		}
+		return nil
+	}
+	target := strings.Trim(host+"/"+repository, "/")
+	if target == "" {
+		return fmt.Errorf("%w: %s is not allowed to %s", ErrForbidden, identity.Username, action)
+	}
+	return fmt.Errorf("%w: %s is not allowed to %s %s", ErrForbidden, identity.Username, action, target)
+}
+
+// registryHost 去掉协议和末尾的 /，只保留 host[:port]
+func registryHost(registry string) string {
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.TrimSuffix(registry, "/")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, match func(string) bool) bool {
+	for _, p := range patterns {
+		if match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRegistry(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(registryHost(pattern)), strings.ToLower(host))
+	return ok
+}
+
+// matchRepository 仓库路径匹配，以 /* 结尾的规则匹配任意层级
+func matchRepository(pattern, repository string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return matchSegments(strings.Split(strings.TrimSuffix(pattern, "/*"), "/"), strings.Split(repository, "/"), true)
+	}
+	ok, _ := path.Match(pattern, repository)
+	return ok
+}
+
+// matchRepositoryPrefix prefix 下是否存在可以被规则匹配的仓库
+func matchRepositoryPrefix(pattern, prefix string) bool {
+	if pattern == "*" {
+		return true
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		// 没有前缀时，镜像直接推送到仓库根路径下
+		return !strings.Contains(pattern, "/")
+	}
+	ps := strings.Split(pattern, "/")
+	xs := strings.Split(prefix, "/")
+	if ps[len(ps)-1] == "*" {
+		return matchSegments(ps[:len(ps)-1], xs, false) || matchSegments(ps[:len(ps)-1], xs, true)
+	}
+	// 规则的最后一段是镜像名，前缀必须正好匹配前面的部分
+	return len(ps) == len(xs)+1 && matchSegments(ps[:len(ps)-1], xs, false)
+}
+
+// matchSegments 逐段匹配，deeper 为 true 时 xs 可以比 ps 更长（但至少要多一段）
+func matchSegments(ps, xs []string, deeper bool) bool {
+	if deeper && len(xs) <= len(ps) {
+		return false
+	}
+	if !deeper && len(xs) != len(ps) {
+		return false
+	}
+	for i, p := range ps {
+		if ok, _ := path.Match(p, xs[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
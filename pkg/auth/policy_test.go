@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchRepository(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		repository string
+		want       bool
+	}{
+		{"*", "nginx", true},
+		{"*", "team-a/app", true},
+		{"nginx", "nginx", true},
+		{"nginx", "library/nginx", false},
+		{"team-a/*", "team-a/app", true},
+		{"team-a/*", "team-a/sub/app", true},
+		{"team-a/*", "team-a", false},
+		{"team-a/*", "team-b/app", false},
+		{"team-a/*", "team-a-x/app", false},
+		{"team-*/app", "team-a/app", true},
+		{"team-*/app", "team-a/other", false},
+		{"team-*/*", "team-b/x/y", true},
+		{"team-a/app-?", "team-a/app-1", true},
+		{"team-a/app-?", "team-a/app-10", false},
+		{"*/app", "team-a/app", true},
+		{"*/app", "team-a/sub/app", false},
+	}
+	for _, tt := range tests {
+		if got := matchRepository(tt.pattern, tt.repository); got != tt.want {
+			t.Errorf("matchRepository(%q, %q) = %v, want %v", tt.pattern, tt.repository, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRepositoryPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		prefix  string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "team-a", true},
+		{"nginx", "", true},
+		{"team-a/*", "", false},
+		{"team-a/*", "team-a", true},
+		{"team-a/*", "/team-a/", true},
+		{"team-a/*", "team-a/sub", true},
+		{"team-a/*", "team-b", false},
+		{"team-a/app", "team-a", true},
+		{"team-a/app", "team-a/sub", false},
+		{"team-*/app", "team-b", true},
+	}
+	for _, tt := range tests {
+		if got := matchRepositoryPrefix(tt.pattern, tt.prefix); got != tt.want {
+			t.Errorf("matchRepositoryPrefix(%q, %q) = %v, want %v", tt.pattern, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cfg := &Config{Roles: []Role{
+		{Name: "team-a", Actions: []string{ActionUpload, ActionPush}, Registries: []string{"harbor.internal"}, Repositories: []string{"team-a/*"}},
+		{Name: "ops", Actions: []string{"*"}, Registries: []string{"*"}, Repositories: []string{"*"}},
+	}}
+	alice := &Identity{Username: "alice", Roles: []string{"team-a"}}
+	tests := []struct {
+		name       string
+		identity   *Identity
+		action     string
+		registry   string
+		repository string
+		allowed    bool
+	}{
+		{"not logged in", nil, ActionPush, "harbor.internal", "team-a/app", false},
+		{"admin", &Identity{Username: "root", Roles: []string{RoleAdmin}}, ActionDelete, "any.registry", "x/y", true},
+		{"matching role", alice, ActionPush, "https://harbor.internal/", "team-a/app", true},
+		{"other repository", alice, ActionPush, "harbor.internal", "team-b/app", false},
+		{"other registry", alice, ActionPush, "docker.io", "team-a/app", false},
+		{"action not granted", alice, ActionDelete, "harbor.internal", "team-a/app", false},
+		{"wildcard role", &Identity{Username: "bob", Roles: []string{"ops"}}, ActionDelete, "docker.io", "x", true},
+		{"no role", &Identity{Username: "carol"}, ActionUpload, "", "", false},
+	}
+	for _, tt := range tests {
+		err := cfg.Authorize(tt.identity, tt.action, tt.registry, tt.repository)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected ErrForbidden, got %v", tt.name, err)
+		}
+	}
+
+	// 没有配置角色时只限制删除
+	open := &Config{}
+	if err := open.Authorize(alice, ActionPush, "docker.io", "any/app"); err != nil {
+		t.Errorf("push without roles: %v", err)
+	}
+	if err := open.Authorize(alice, ActionDelete, "docker.io", "any/app"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("delete without roles: expected ErrForbidden, got %v", err)
+	}
+}
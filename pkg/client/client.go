@@ -0,0 +1,293 @@
+// Package client 访问远程 docker-tar-push-ui 服务的接口：上传镜像包、创建推送任务、查看任务和日志
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-tar-push-ui/pkg/push"
+)
+
+// Client 远程服务的客户端
+type Client struct {
+	server     string
+	token      string
+	workspace  string
+	httpClient *http.Client
+}
+
+// Options 连接远程服务的参数
+type Options struct {
+	Server        string // 服务地址，例如 https://dtp.example.com
+	Token         string // API Token，没有开启认证时可以为空
+	Workspace     string // 工作空间，为空时使用服务端的默认值
+	SkipSSLVerify bool
+	CACert        string // 服务端证书的 CA 文件
+	ClientCert    string // 服务端要求客户端证书时使用
+	ClientKey     string
+}
+
+// APIError 服务端返回的错误
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// PushRequest 创建推送任务的参数，指定 Profile 时使用服务端保存的仓库配置
+type PushRequest struct {
+	Archive       string `json:"archive"`
+	Profile       string `json:"profile,omitempty"`
+	Endpoint      string `json:"endpoint,omitempty"`
+	Prefix        string `json:"prefix,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	SkipSSLVerify bool   `json:"skipSSLVerify,omitempty"`
+	MaxBandwidth  string `json:"maxBandwidth,omitempty"` // 任务的上传带宽（每秒），例如 10M
+	// UploadStrategy、UploadChunkSize 服务端上传 blob 到仓库的方式和分片大小
+	UploadStrategy  string `json:"uploadStrategy,omitempty"`
+	UploadChunkSize string `json:"uploadChunkSize,omitempty"`
+	// Tag 替换镜像包里的 tag，写成 name:tag 时同时替换镜像名
+	Tag string `json:"tag,omitempty"`
+	// ExtraTags 每个镜像推送完成后额外加上的 tag，逗号分隔，例如 latest,stable
+	ExtraTags string `json:"extraTags,omitempty"`
+	// DigestOnly 只按 digest 推送，不产生 tag
+	DigestOnly bool `json:"digestOnly,omitempty"`
+}
+
+// Job 推送任务
+type Job struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Workspace string `json:"workspace"`
+	User      string `json:"user"`
+	Archive   string `json:"archive"`
+	Profile   string `json:"profile"`
+	Registry  string `json:"registry"`
+	Prefix    string `json:"prefix"`
+	// MaxBandwidth 任务的限速，每秒字节数
+	MaxBandwidth int64         `json:"maxBandwidth"`
+	Results      []push.Result `json:"results"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	StartedAt    *time.Time    `json:"startedAt"`
+	FinishedAt   *time.Time    `json:"finishedAt"`
+}
+
+// Done 任务是否已经结束
+func (j *Job) Done() bool {
+	return j.Status == "succeeded" || j.Status == "failed" || j.Status == "canceled"
+}
+
+// New 创建客户端
+func New(opts Options) (*Client, error) {
+	if opts.Server == "" {
+		return nil, fmt.Errorf("server address is required")
+	}
+	server := strings.TrimSuffix(opts.Server, "/")
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		server = "http://" + server
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.SkipSSLVerify}
+	if opts.CACert != "" {
+		data, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	return &Client{
+		server:     server,
+		token:      opts.Token,
+		workspace:  opts.Workspace,
+		httpClient: &http.Client{Transport: tr},
+	}, nil
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.workspace != "" {
+		req.Header.Set("X-Workspace", c.workspace)
+	}
+	return req, nil
+}
+
+// do 发送请求，非 2xx 的响应转换成 APIError
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		apiErr.Message = body.Error
+	}
+	return nil, apiErr
+}
+
+// doJSON 发送 JSON 请求并解析 JSON 响应，in、out 为 nil 时忽略
+func (c *Client) doJSON(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// CreatePush 创建推送任务
+func (c *Client) CreatePush(req PushRequest) (*Job, error) {
+	var job Job
+	if err := c.doJSON(http.MethodPost, "/api/v1/pushes", req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs 工作空间的推送任务，最新的在前
+func (c *Client) Jobs() ([]Job, error) {
+	var resp struct {
+		Pushes []Job `json:"pushes"`
+	}
+	if err := c.doJSON(http.MethodGet, "/api/v1/pushes", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Pushes, nil
+}
+
+// Job 推送任务的状态
+func (c *Client) Job(id string) (*Job, error) {
+	var resp struct {
+		Push Job `json:"push"`
+	}
+	if err := c.doJSON(http.MethodGet, "/api/v1/pushes/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Push, nil
+}
+
+// Cancel 取消推送任务
+func (c *Client) Cancel(id string) error {
+	return c.doJSON(http.MethodDelete, "/api/v1/pushes/"+url.PathEscape(id), nil, nil)
+}
+
+// SetBandwidth 调整任务的限速，rate 例如 10M，0 表示取消任务的限速
+func (c *Client) SetBandwidth(id, rate string) (*Job, error) {
+	var job Job
+	if err := c.doJSON(http.MethodPut, "/api/v1/pushes/"+url.PathEscape(id)+"/bandwidth", map[string]string{"maxBandwidth": rate}, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SetGlobalBandwidth 调整服务端所有推送共享的带宽，需要管理员权限，返回生效的每秒字节数
+func (c *Client) SetGlobalBandwidth(rate string) (int64, error) {
+	var resp struct {
+		MaxBandwidth int64 `json:"maxBandwidth"`
+	}
+	if err := c.doJSON(http.MethodPut, "/api/v1/bandwidth", map[string]string{"maxBandwidth": rate}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.MaxBandwidth, nil
+}
+
+// Logs 从 offset 开始的任务日志，返回下一次读取的 offset 和任务当前的状态
+func (c *Client) Logs(id string, offset int64) ([]byte, int64, string, error) {
+	req, err := c.newRequest(http.MethodGet, "/api/v1/pushes/"+url.PathEscape(id)+"/logs?offset="+strconv.FormatInt(offset, 10), nil)
+	if err != nil {
+		return nil, offset, "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, offset, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, offset, "", err
+	}
+	next, err := strconv.ParseInt(resp.Header.Get("X-Log-Offset"), 10, 64)
+	if err != nil {
+		next = offset + int64(len(data))
+	}
+	return data, next, resp.Header.Get("X-Push-Status"), nil
+}
+
+// FollowLogs 持续把任务日志写到 w，直到任务结束，返回结束时的任务状态
+func (c *Client) FollowLogs(id string, w io.Writer, interval time.Duration) (*Job, error) {
+	var offset int64
+	for {
+		data, next, status, err := c.Logs(id, offset)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		offset = next
+		if status == "succeeded" || status == "failed" || status == "canceled" {
+			// 状态变化和最后几行日志之间可能有间隔，再读一次
+			data, _, _, err := c.Logs(id, offset)
+			if err == nil {
+				w.Write(data)
+			}
+			return c.Job(id)
+		}
+		time.Sleep(interval)
+	}
+}
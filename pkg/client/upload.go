@@ -0,0 +1,132 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"docker-tar-push-ui/pkg/util"
+)
+
+// 每个分片失败后的最大重试次数
+const maxChunkRetries = 5
+
+// uploadSession 服务端 /upload/sessions 返回的上传进度
+type uploadSession struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+}
+
+// UploadResult 上传完成后服务端计算的 sha256
+type UploadResult struct {
+	Filename string
+	Sha256   string
+}
+
+// Upload 分片上传文件，服务端已经有同名同大小未完成的上传时从中断的位置继续
+//
+// progress 不为 nil 时每个分片上传完后回调
+func (c *Client) Upload(file string, chunkSize int64, progress func(done, total int64)) (*UploadResult, error) {
+	if chunkSize <= 0 {
+		chunkSize = 8 << 20
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 提前计算 sha256，服务端完成上传时校验
+	sum, err := util.Sha256Hash(file)
+	if err != nil {
+		return nil, err
+	}
+	var s uploadSession
+	create := map[string]interface{}{"filename": filepath.Base(file), "size": info.Size(), "sha256": sum}
+	if err := c.doJSON(http.MethodPost, "/upload/sessions", create, &s); err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		progress(s.Offset, s.Size)
+	}
+
+	retries := 0
+	for s.Offset < s.Size {
+		n := chunkSize
+		if remain := s.Size - s.Offset; remain < n {
+			n = remain
+		}
+		offset, err := c.uploadChunk(f, s.ID, s.Offset, n)
+		if err != nil {
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && apiErr.StatusCode != http.StatusConflict && apiErr.StatusCode < 500 {
+				return nil, err
+			}
+			retries++
+			if retries > maxChunkRetries {
+				return nil, fmt.Errorf("upload chunk at offset %d failed after %d retries: %w", s.Offset, maxChunkRetries, err)
+			}
+			time.Sleep(time.Duration(retries) * time.Second)
+			// 以服务端记录的进度为准
+			if offset, err = c.uploadOffset(s.ID); err != nil {
+				continue
+			}
+		} else {
+			retries = 0
+		}
+		s.Offset = offset
+		if progress != nil {
+			progress(s.Offset, s.Size)
+		}
+	}
+
+	var done struct {
+		Sha256 string `json:"sha256"`
+	}
+	if err := c.doJSON(http.MethodPost, "/upload/sessions/"+url.PathEscape(s.ID)+"/complete", map[string]string{"sha256": sum}, &done); err != nil {
+		return nil, err
+	}
+	return &UploadResult{Filename: s.Filename, Sha256: done.Sha256}, nil
+}
+
+// uploadChunk 上传 offset 开始的 n 个字节，返回服务端记录的新进度
+func (c *Client) uploadChunk(f *os.File, id string, offset, n int64) (int64, error) {
+	req, err := c.newRequest(http.MethodPatch, "/upload/sessions/"+url.PathEscape(id), io.NewSectionReader(f, offset, n))
+	if err != nil {
+		return offset, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := c.do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// uploadOffset 查询服务端记录的上传进度
+func (c *Client) uploadOffset(id string) (int64, error) {
+	req, err := c.newRequest(http.MethodHead, "/upload/sessions/"+url.PathEscape(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
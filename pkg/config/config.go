@@ -0,0 +1,266 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/silenceper/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 服务配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+//
+// 环境变量为 DTP_ 加上大写的参数名，例如 --upload-dir 对应 DTP_UPLOAD_DIR；
+// 兼容 Dockerfile 和 deploy.yaml 里的 ROOT、TMP_DIR，相对路径都基于 root 目录
+type Config struct {
+	Listen          string `yaml:"listen"`
+	Root            string `yaml:"root"`
+	UploadDir       string `yaml:"uploadDir"`
+	TmpDir          string `yaml:"tmpDir"`
+	MaxUploadSize   string `yaml:"maxUploadSize"`
+	JobConcurrency  int    `yaml:"jobConcurrency"`
+	DefaultProfile  string `yaml:"defaultProfile"`
+	LogLevel        string `yaml:"logLevel"`
+	AuthConfig      string `yaml:"authConfig"`
+	ProfilesFile    string `yaml:"profilesFile"`
+	MasterKeyFile   string `yaml:"masterKeyFile"`
+	AuditLog        string `yaml:"auditLog"`
+	AuditMaxSize    string `yaml:"auditMaxSize"`
+	AuditMaxBackups int    `yaml:"auditMaxBackups"`
+	ShutdownTimeout string `yaml:"shutdownTimeout"`
+	MinFreeDisk     string `yaml:"minFreeDisk"`
+	MaxBandwidth    string `yaml:"maxBandwidth"`
+	UploadStrategy  string `yaml:"uploadStrategy"`
+	UploadChunkSize string `yaml:"uploadChunkSize"`
+	MetricsPublic   bool   `yaml:"metricsPublic"` // 开启认证后 /metrics 仍然不需要认证，给 prometheus.io/scrape 注解使用
+	TLS             TLS    `yaml:"tls"`
+}
+
+// TLS 配置了证书后使用 https 监听
+type TLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// SelfSigned 证书文件不存在时自动生成自签名证书，没有配置证书路径时保存到 data/tls.crt、data/tls.key
+	SelfSigned bool `yaml:"selfSigned"`
+	// ClientCAFile 配置后要求客户端提供由这个 CA 签发的证书
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// Enabled 是否使用 https
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+// Default 默认配置
+func Default() *Config {
+	return &Config{
+		Listen:          ":8088",
+		Root:            ".",
+		UploadDir:       "uploads",
+		TmpDir:          "tmp",
+		ProfilesFile:    "data/profiles.json",
+		AuditLog:        "data/audit.log",
+		MaxUploadSize:   "0",
+		JobConcurrency:  2,
+		LogLevel:        "info",
+		AuditMaxSize:    "100M",
+		AuditMaxBackups: 10,
+		ShutdownTimeout: "2m",
+		MinFreeDisk:     "512M",
+		MaxBandwidth:    "0",
+		UploadStrategy:  "auto",
+		UploadChunkSize: "2M",
+	}
+}
+
+// Keys 所有配置项的名称，同时也是命令行参数的名称
+var Keys = []string{
+	"listen", "root", "upload-dir", "tmp-dir", "max-upload-size", "job-concurrency",
+	"default-profile", "log-level", "auth-config", "profiles-file", "master-key-file",
+	"audit-log", "audit-max-size", "audit-max-backups", "shutdown-timeout", "min-free-disk",
+	"max-bandwidth", "upload-strategy", "upload-chunk-size", "metrics-public", "tls-cert", "tls-key", "tls-self-signed", "tls-client-ca",
+}
+
+// Load 读取默认值、配置文件和环境变量，file 为空时只使用默认值和环境变量
+func Load(file string) (*Config, error) {
+	cfg := Default()
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %s failed: %w", file, err)
+		}
+	}
+	// 兼容旧的环境变量
+	for env, key := range map[string]string{"ROOT": "root", "TMP_DIR": "tmp-dir"} {
+		if v, ok := os.LookupEnv(env); ok && v != "" {
+			if err := cfg.Set(key, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	for _, key := range Keys {
+		env := "DTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok {
+			if err := cfg.Set(key, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Set 按名称设置配置项，命令行参数和环境变量都通过这里设置
+func (cfg *Config) Set(key, value string) error {
+	switch key {
+	case "listen":
+		// 兼容只写端口的情况
+		if _, err := strconv.Atoi(value); err == nil {
+			value = ":" + value
+		}
+		cfg.Listen = value
+	case "root":
+		cfg.Root = value
+	case "upload-dir":
+		cfg.UploadDir = value
+	case "tmp-dir":
+		cfg.TmpDir = value
+	case "max-upload-size":
+		cfg.MaxUploadSize = value
+	case "job-concurrency":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid job-concurrency %q", value)
+		}
+		cfg.JobConcurrency = n
+	case "default-profile":
+		cfg.DefaultProfile = value
+	case "log-level":
+		cfg.LogLevel = value
+	case "auth-config":
+		cfg.AuthConfig = value
+	case "profiles-file":
+		cfg.ProfilesFile = value
+	case "master-key-file":
+		cfg.MasterKeyFile = value
+	case "audit-log":
+		cfg.AuditLog = value
+	case "audit-max-size":
+		cfg.AuditMaxSize = value
+	case "audit-max-backups":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid audit-max-backups %q", value)
+		}
+		cfg.AuditMaxBackups = n
+	case "shutdown-timeout":
+		cfg.ShutdownTimeout = value
+	case "min-free-disk":
+		cfg.MinFreeDisk = value
+	case "max-bandwidth":
+		cfg.MaxBandwidth = value
+	case "upload-strategy":
+		cfg.UploadStrategy = value
+	case "upload-chunk-size":
+		cfg.UploadChunkSize = value
+	case "metrics-public":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid metrics-public %q", value)
+		}
+		cfg.MetricsPublic = b
+	case "tls-cert":
+		cfg.TLS.CertFile = value
+	case "tls-key":
+		cfg.TLS.KeyFile = value
+	case "tls-self-signed":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid tls-self-signed %q", value)
+		}
+		cfg.TLS.SelfSigned = b
+	case "tls-client-ca":
+		cfg.TLS.ClientCAFile = value
+	default:
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	return nil
+}
+
+// Path 相对路径基于 root 目录
+func (cfg *Config) Path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(cfg.Root, p)
+}
+
+// Validate 检查配置是否合法，并补全依赖其他配置项的默认值
+func (cfg *Config) Validate() error {
+	if cfg.TLS.SelfSigned && cfg.TLS.CertFile == "" && cfg.TLS.KeyFile == "" {
+		cfg.TLS.CertFile = "data/tls.crt"
+		cfg.TLS.KeyFile = "data/tls.key"
+	}
+	for name, v := range map[string]string{"max-upload-size": cfg.MaxUploadSize, "audit-max-size": cfg.AuditMaxSize, "min-free-disk": cfg.MinFreeDisk, "max-bandwidth": cfg.MaxBandwidth, "upload-chunk-size": cfg.UploadChunkSize} {
+		if _, err := util.ParseSize(v); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if _, err := push.ParseUploadStrategy(cfg.UploadStrategy); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(cfg.ShutdownTimeout); err != nil {
+		return fmt.Errorf("invalid shutdown-timeout: %w", err)
+	}
+	if cfg.AuditMaxBackups < 0 {
+		return fmt.Errorf("audit-max-backups must not be negative")
+	}
+	if cfg.JobConcurrency < 1 {
+		return fmt.Errorf("job-concurrency must be at least 1")
+	}
+	if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if cfg.TLS.ClientCAFile != "" && !cfg.TLS.Enabled() {
+		return fmt.Errorf("tls-client-ca requires tls-cert or tls-self-signed")
+	}
+	return nil
+}
+
+// ParseLogLevel 支持 fatal/error/warn/info/debug 或者对应的数字 0-4
+func ParseLogLevel(level string) (log.Level, error) {
+	switch strings.ToLower(level) {
+	case "fatal", "0":
+		return log.LevelFatal, nil
+	case "error", "1":
+		return log.LevelError, nil
+	case "warn", "warning", "2":
+		return log.LevelWarning, nil
+	case "info", "3":
+		return log.LevelInfo, nil
+	case "debug", "4":
+		return log.LevelDebug, nil
+	}
+	return 0, fmt.Errorf("invalid log-level %q", level)
+}
+
+// String 生效的配置，启动时打印
+func (cfg *Config) String() string {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,107 @@
+package profile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// MasterKeyEnv 主密钥环境变量
+	MasterKeyEnv = "DTP_MASTER_KEY"
+	// MasterKeyFileEnv 主密钥文件环境变量
+	MasterKeyFileEnv = "DTP_MASTER_KEY_FILE"
+
+	encPrefix = "enc:v1:"
+)
+
+// ErrNoMasterKey 没有配置主密钥，不能保存或读取密码
+var ErrNoMasterKey = errors.New("master key is not configured, set " + MasterKeyEnv + " or " + MasterKeyFileEnv)
+
+// LoadMasterKey 读取主密钥，优先使用 file，其次是环境变量 DTP_MASTER_KEY_FILE、DTP_MASTER_KEY；都没有时返回 nil
+func LoadMasterKey(file string) ([]byte, error) {
+	if file == "" {
+		file = os.Getenv(MasterKeyFileEnv)
+	}
+	secret := ""
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read master key file failed: %w", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	} else {
+		secret = os.Getenv(MasterKeyEnv)
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("master key is too short, at least 16 characters")
+	}
+	// 任意长度的密钥都转换成 32 字节的 AES-256 密钥
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+// encrypt AES-256-GCM 加密，结果为 enc:v1:base64(nonce+密文)
+func encrypt(key []byte, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if key == nil {
+		return "", ErrNoMasterKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(key []byte, ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+	if key == nil {
+		return "", ErrNoMasterKey
+	}
+	if !strings.HasPrefix(ciphertext, encPrefix) {
+		return "", fmt.Errorf("unsupported encrypted value")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, encPrefix))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt failed, wrong master key? %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,210 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+)
+
+// ErrNotFound 配置不存在
+var ErrNotFound = errors.New("profile not found")
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// Profile 镜像仓库配置，密码加密后保存在服务端
+type Profile struct {
+	Name          string `json:"name"`
+	Endpoint      string `json:"endpoint"`
+	Prefix        string `json:"prefix"`
+	Username      string `json:"username"`
+	Password      string `json:"password,omitempty"` // 只在保存时传入，返回时不会带上
+	HasPassword   bool   `json:"hasPassword"`
+	SkipSSLVerify bool   `json:"skipSSLVerify"`
+	CACert        string `json:"caCert,omitempty"`       // 自签名证书的 CA（PEM）
+	MaxBandwidth  string `json:"maxBandwidth,omitempty"` // 推送到这个仓库的所有任务共享的上传带宽（每秒），例如 10M，为空表示不限速
+	// UploadStrategy、UploadChunkSize 上传 blob 的方式和分片大小，为空时使用服务的配置
+	UploadStrategy  string    `json:"uploadStrategy,omitempty"`
+	UploadChunkSize string    `json:"uploadChunkSize,omitempty"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// stored 保存到文件里的格式，密码是密文
+type stored struct {
+	Profile
+	PasswordEnc string `json:"passwordEnc,omitempty"`
+}
+
+// Store 保存在一个 JSON 文件里的仓库配置
+type Store struct {
+	file string
+	key  []byte
+
+	mu       sync.Mutex
+	profiles map[string]*stored
+}
+
+// NewStore 打开配置文件，文件不存在时为空
+func NewStore(file string, key []byte) (*Store, error) {
+	s := &Store{file: file, key: key, profiles: map[string]*stored{}}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*stored
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse profiles file %s failed: %w", file, err)
+	}
+	for _, p := range list {
+		s.profiles[p.Name] = p
+	}
+	return s, nil
+}
+
+// Encrypted 是否配置了主密钥
+func (s *Store) Encrypted() bool {
+	return s.key != nil
+}
+
+// List 所有配置，不包含密码
+func (s *Store) List() []Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, p.public())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Get 配置，不包含密码
+func (s *Store) Get(name string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[name]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return p.public(), nil
+}
+
+// Resolve 推送时使用，返回解密后的密码
+func (s *Store) Resolve(name string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	password, err := decrypt(s.key, p.PasswordEnc)
+	if err != nil {
+		return Profile{}, err
+	}
+	profile := p.Profile
+	profile.Password = password
+	return profile, nil
+}
+
+// Save 新建或更新配置，密码为空时保留原来的密码
+func (s *Store) Save(p Profile) (Profile, error) {
+	if !nameRe.MatchString(p.Name) {
+		return Profile{}, fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	if p.Endpoint == "" {
+		return Profile{}, fmt.Errorf("endpoint is required")
+	}
+	if p.MaxBandwidth != "" {
+		if _, err := util.ParseSize(p.MaxBandwidth); err != nil {
+			return Profile{}, fmt.Errorf("invalid maxBandwidth: %w", err)
+		}
+	}
+	if _, err := push.ParseUploadStrategy(p.UploadStrategy); err != nil {
+		return Profile{}, err
+	}
+	if p.UploadChunkSize != "" {
+		if _, err := util.ParseSize(p.UploadChunkSize); err != nil {
+			return Profile{}, fmt.Errorf("invalid uploadChunkSize: %w", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := &stored{Profile: p}
+	item.Password = ""
+	if p.Password != "" {
+		enc, err := encrypt(s.key, p.Password)
+		if err != nil {
+			return Profile{}, err
+		}
+		item.PasswordEnc = enc
+	} else if old, ok := s.profiles[p.Name]; ok {
+		item.PasswordEnc = old.PasswordEnc
+	}
+	item.UpdatedAt = time.Now()
+	old := s.profiles[p.Name]
+	s.profiles[p.Name] = item
+	if err := s.save(); err != nil {
+		if old != nil {
+			s.profiles[p.Name] = old
+		} else {
+			delete(s.profiles, p.Name)
+		}
+		return Profile{}, err
+	}
+	return item.public(), nil
+}
+
+// Delete 删除配置
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.profiles[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.profiles, name)
+	if err := s.save(); err != nil {
+		s.profiles[name] = old
+		return err
+	}
+	return nil
+}
+
+// save 先写临时文件再重命名，文件只有当前用户可读
+func (s *Store) save() error {
+	list := make([]*stored, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (p *stored) public() Profile {
+	profile := p.Profile
+	profile.Password = ""
+	profile.HasPassword = p.PasswordEnc != ""
+	return profile
+}
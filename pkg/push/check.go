@@ -0,0 +1,545 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 检查项的结果
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// 是否支持跨仓库挂载、OCI 格式
+const (
+	Supported   = "supported"
+	Unsupported = "unsupported"
+	Unknown     = "unknown"
+)
+
+// CheckRepository 没有指定仓库时用来检查推送权限的仓库名（加上镜像前缀），只创建上传会话，不会真正推送
+const CheckRepository = "docker-tar-push-check"
+
+// emptyJSON 写入检查时上传的 blob，即 OCI 规范里的空 JSON "{}"
+var (
+	emptyJSON       = []byte("{}")
+	emptyJSONDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+)
+
+// CheckItem 一项检查的结果
+type CheckItem struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// CheckReport 仓库连接检查的结果
+type CheckReport struct {
+	Registry       string      `json:"registry"`
+	Repository     string      `json:"repository,omitempty"`
+	Scheme         string      `json:"scheme"`
+	APIVersion     string      `json:"apiVersion,omitempty"`
+	AuthScheme     string      `json:"authScheme,omitempty"` // none、basic、bearer
+	TokenEndpoint  string      `json:"tokenEndpoint,omitempty"`
+	Service        string      `json:"service,omitempty"`
+	Credentials    bool        `json:"credentials"` // 账号密码有效，匿名访问时为 false
+	PushAllowed    bool        `json:"pushAllowed"`
+	CrossRepoMount string      `json:"crossRepoMount"`
+	OCI            string      `json:"oci"`
+	Items          []CheckItem `json:"items"`
+	OK             bool        `json:"ok"` // 没有失败的检查项
+}
+
+func (r *CheckReport) add(name, status, format string, v ...interface{}) {
+	r.Items = append(r.Items, CheckItem{Name: name, Status: status, Message: fmt.Sprintf(format, v...)})
+	if status == CheckFail {
+		r.OK = false
+	}
+}
+
+// Check 推送前检查仓库地址、证书、认证和推送权限，repository 为空时不检查推送权限
+//
+// write 为 true 时上传一个 2 字节的 blob（先传到同一个命名空间下的 CheckRepository-src 再挂载过来）和一个不带 tag 的 manifest，
+// 用来检查跨仓库挂载和 OCI 格式，检查完后尝试删除 manifest
+func (imagePush *ImagePush) Check(ctx context.Context, repository string, write bool) *CheckReport {
+	imagePush.ctx = ctx
+	r := &CheckReport{
+		Registry:       imagePush.registryEndpoint,
+		Repository:     repository,
+		CrossRepoMount: Unknown,
+		OCI:            Unknown,
+		OK:             true,
+	}
+	u, err := url.Parse(imagePush.registryEndpoint)
+	if err != nil {
+		r.add("endpoint", CheckFail, "invalid registry url: %v", err)
+		return r
+	}
+	r.Scheme = u.Scheme
+	switch {
+	case u.Scheme == "http":
+		r.add("scheme", CheckWarn, "plain HTTP, credentials and images are sent unencrypted")
+	case imagePush.skipSSLVerify:
+		// 跳过验证时推送不受证书影响，但仍然提示证书的问题
+		if err := verifyCertificate(ctx, imagePush.registryEndpoint); isCertificateError(err) {
+			r.add("scheme", CheckWarn, "HTTPS with certificate verification disabled, %s", describeConnError(err, u.Scheme))
+		} else {
+			r.add("scheme", CheckWarn, "HTTPS with certificate verification disabled")
+		}
+	default:
+		r.add("scheme", CheckOK, "HTTPS")
+	}
+
+	challenge, ok := imagePush.checkPing(r)
+	if !ok {
+		return r
+	}
+	token, ok := imagePush.checkAuth(r, challenge)
+	if !ok || repository == "" {
+		if repository == "" {
+			r.add("push", CheckSkip, "no repository given, push permission not checked")
+		}
+		return r
+	}
+	if token, ok = imagePush.checkPush(r, challenge, token); !ok {
+		return r
+	}
+	if !write {
+		r.add("mount", CheckSkip, "cross-repo mount not checked, enable the write test to check it")
+		r.add("oci", CheckSkip, "OCI media types not checked, enable the write test to check them")
+		return r
+	}
+	imagePush.checkWrite(r, token)
+	return r
+}
+
+// checkPing 请求 /v2/，返回认证方式
+func (imagePush *ImagePush) checkPing(r *CheckReport) (string, bool) {
+	resp, err := imagePush.checkRequest(http.MethodGet, imagePush.registryEndpoint+"/v2/", nil, "", "")
+	if err != nil {
+		r.add("connect", CheckFail, "%s", describeConnError(err, r.Scheme))
+		return "", false
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	r.APIVersion = resp.Header.Get("Docker-Distribution-Api-Version")
+	switch {
+	case resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "HTTPS"):
+		r.add("connect", CheckFail, "the server expects HTTPS, use https:// in the registry url")
+		return "", false
+	case resp.StatusCode == http.StatusNotFound:
+		r.add("connect", CheckFail, "GET /v2/ returned 404, the url is not a docker registry (v2 API)")
+		return "", false
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized:
+		r.add("connect", CheckFail, "GET /v2/ returned %d", resp.StatusCode)
+		return "", false
+	}
+	if r.APIVersion == "" {
+		r.add("connect", CheckWarn, "reachable, but the Docker-Distribution-Api-Version header is missing")
+	} else {
+		r.add("connect", CheckOK, "reachable, api version %s", r.APIVersion)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return "", true
+	}
+	return resp.Header.Get("Www-Authenticate"), true
+}
+
+// checkAuth 检查认证方式和账号密码，bearer 认证时返回不带权限范围的 token
+func (imagePush *ImagePush) checkAuth(r *CheckReport, challenge string) (string, bool) {
+	scheme, params := parseChallenge(challenge)
+	r.AuthScheme = scheme
+	switch scheme {
+	case "":
+		r.AuthScheme = "none"
+		r.add("auth", CheckOK, "anonymous access, no authentication required")
+		return "", true
+	case "basic":
+		if imagePush.username == "" {
+			r.add("auth", CheckFail, "basic auth is required but no username is configured")
+			return "", false
+		}
+		resp, err := imagePush.checkRequest(http.MethodGet, imagePush.registryEndpoint+"/v2/", nil, "", "")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err != nil || resp.StatusCode != http.StatusOK {
+			r.add("auth", CheckFail, "basic auth: invalid username or password")
+			return "", false
+		}
+		r.Credentials = true
+		r.add("auth", CheckOK, "basic auth, credentials accepted")
+		return "", true
+	case "bearer":
+		r.TokenEndpoint, r.Service = params["realm"], params["service"]
+		if r.TokenEndpoint == "" {
+			r.add("auth", CheckFail, "bearer auth without a token endpoint (realm)")
+			return "", false
+		}
+		token, status, err := imagePush.requestToken(r.TokenEndpoint, r.Service, "")
+		if err != nil {
+			if status == http.StatusUnauthorized || status == http.StatusForbidden {
+				r.add("auth", CheckFail, "token endpoint %s rejected the credentials (%d): invalid username or password", r.TokenEndpoint, status)
+			} else {
+				r.add("auth", CheckFail, "token endpoint %s: %v", r.TokenEndpoint, err)
+			}
+			return "", false
+		}
+		if imagePush.username == "" {
+			r.add("auth", CheckWarn, "bearer auth via %s, no username configured, using anonymous token", r.TokenEndpoint)
+		} else {
+			r.Credentials = true
+			r.add("auth", CheckOK, "bearer auth via %s, credentials accepted", r.TokenEndpoint)
+		}
+		return token, true
+	}
+	r.add("auth", CheckFail, "unsupported auth scheme %q", scheme)
+	return "", false
+}
+
+// checkPush 申请推送权限并创建一个上传会话，成功后取消，返回带推送权限的 token
+func (imagePush *ImagePush) checkPush(r *CheckReport, challenge, token string) (string, bool) {
+	if r.AuthScheme == "bearer" {
+		scope := fmt.Sprintf("repository:%s:pull,push", r.Repository)
+		t, _, err := imagePush.requestToken(r.TokenEndpoint, r.Service, scope)
+		if err != nil {
+			r.add("push", CheckFail, "request token with scope %s failed: %v", scope, err)
+			return "", false
+		}
+		token = t
+		if actions, ok := tokenActions(token, r.Repository); ok && !contains(actions, "push") {
+			r.add("push", CheckFail, "token for %s only grants [%s], the account can not push to this repository", r.Repository, strings.Join(actions, ","))
+			return "", false
+		}
+	}
+	resp, err := imagePush.checkRequest(http.MethodPost, fmt.Sprintf("%s/v2/%s/blobs/uploads/", imagePush.registryEndpoint, r.Repository), nil, token, "")
+	if err != nil {
+		r.add("push", CheckFail, "start upload failed: %v", err)
+		return "", false
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		imagePush.checkCancelUpload(resp, token)
+		r.PushAllowed = true
+		r.add("push", CheckOK, "push to %s allowed", r.Repository)
+		return token, true
+	case http.StatusUnauthorized, http.StatusForbidden:
+		r.add("push", CheckFail, "no permission to push to %s (%d)", r.Repository, resp.StatusCode)
+	case http.StatusNotFound:
+		r.add("push", CheckFail, "repository %s not found (%d), check that the project / namespace exists", r.Repository, resp.StatusCode)
+	default:
+		r.add("push", CheckFail, "start upload to %s returned %d", r.Repository, resp.StatusCode)
+	}
+	return "", false
+}
+
+// checkWrite 把空 JSON blob 上传到同一个命名空间下的另一个仓库，再挂载到被检查的仓库，检查跨仓库挂载，
+// 然后上传一个 OCI manifest 检查是否支持 OCI 格式
+func (imagePush *ImagePush) checkWrite(r *CheckReport, token string) {
+	base := fmt.Sprintf("%s/v2/%s", imagePush.registryEndpoint, r.Repository)
+	source := checkMountSource(r.Repository)
+	mounted := false
+	if mountToken, err := imagePush.checkMountToken(r, source, token); err != nil {
+		r.add("mount", CheckWarn, "cross-repo mount not checked, request token for %s failed: %v", source, err)
+	} else if err := imagePush.checkUploadBlob(source, mountToken); err != nil {
+		r.add("mount", CheckWarn, "cross-repo mount not checked, %v", err)
+	} else {
+		// 支持时返回 201，不支持（或者不能从源仓库挂载）时会当成普通上传返回 202
+		resp, err := imagePush.checkRequest(http.MethodPost, fmt.Sprintf("%s/blobs/uploads/?mount=%s&from=%s", base, emptyJSONDigest, url.QueryEscape(source)), nil, mountToken, "")
+		if err != nil {
+			r.add("mount", CheckWarn, "mount request failed: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusCreated {
+				mounted = true
+				token = mountToken
+				r.CrossRepoMount = Supported
+				r.add("mount", CheckOK, "cross-repo blob mount from %s supported", source)
+			} else {
+				if resp.StatusCode == http.StatusAccepted {
+					imagePush.checkCancelUpload(resp, mountToken)
+				}
+				r.CrossRepoMount = Unsupported
+				r.add("mount", CheckWarn, "cross-repo blob mount from %s not supported (%d), blobs are uploaded again for each repository", source, resp.StatusCode)
+			}
+		}
+	}
+	if !mounted {
+		if err := imagePush.checkUploadBlob(r.Repository, token); err != nil {
+			r.add("write", CheckFail, "%v", err)
+			return
+		}
+	}
+	r.add("write", CheckOK, "uploaded test blob %s", emptyJSONDigest)
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": emptyJSONDigest, "size": len(emptyJSON)},
+		"layers":        []interface{}{map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": emptyJSONDigest, "size": len(emptyJSON)}},
+	})
+	digest := "sha256:" + sha256Hex(manifest)
+	resp, err := imagePush.checkRequest(http.MethodPut, base+"/manifests/"+digest, manifest, token, "application/vnd.oci.image.manifest.v1+json")
+	if err != nil {
+		r.add("oci", CheckWarn, "put OCI manifest failed: %v", err)
+		return
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		r.OCI = Unsupported
+		r.add("oci", CheckWarn, "OCI manifest rejected (%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return
+	}
+	r.OCI = Supported
+	r.add("oci", CheckOK, "OCI media types supported")
+	// 删除测试的 manifest，仓库没有开启删除时留下一个不带 tag 的 manifest，垃圾回收时会清理
+	resp, err = imagePush.checkRequest(http.MethodDelete, base+"/manifests/"+digest, nil, token, "")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+			r.add("cleanup", CheckWarn, "delete test manifest %s returned %d, remove it manually or wait for garbage collection", digest, resp.StatusCode)
+		}
+	}
+}
+
+// checkMountSource 检查跨仓库挂载时先上传测试 blob 的仓库，和被检查的仓库在同一个命名空间下，推送权限一般相同
+func checkMountSource(repository string) string {
+	source := CheckRepository + "-src"
+	if i := strings.LastIndex(repository, "/"); i >= 0 {
+		source = repository[:i+1] + source
+	}
+	if source == repository {
+		source += "-2"
+	}
+	return source
+}
+
+// checkMountToken bearer 认证时申请同时包含两个仓库推送权限的 token，其他认证方式直接使用原来的认证
+func (imagePush *ImagePush) checkMountToken(r *CheckReport, source, token string) (string, error) {
+	if r.AuthScheme != "bearer" {
+		return token, nil
+	}
+	scope := fmt.Sprintf("repository:%s:pull,push repository:%s:pull,push", r.Repository, source)
+	token, _, err := imagePush.requestToken(r.TokenEndpoint, r.Service, scope)
+	return token, err
+}
+
+// checkUploadBlob 一次 PUT 上传检查用的空 JSON blob
+func (imagePush *ImagePush) checkUploadBlob(repository, token string) error {
+	uploads := fmt.Sprintf("%s/v2/%s/blobs/uploads/", imagePush.registryEndpoint, repository)
+	resp, err := imagePush.checkRequest(http.MethodPost, uploads, nil, token, "")
+	if err != nil {
+		return fmt.Errorf("start upload to %s failed: %v", repository, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("start upload to %s returned %d", repository, resp.StatusCode)
+	}
+	location := nextLocation(resp, uploads)
+	resp, err = imagePush.checkRequest(http.MethodPut, withDigest(location, strings.TrimPrefix(emptyJSONDigest, "sha256:")), emptyJSON, token, "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("upload test blob to %s failed: %v", repository, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload test blob to %s returned %d", repository, resp.StatusCode)
+	}
+	return nil
+}
+
+func (imagePush *ImagePush) checkCancelUpload(resp *http.Response, token string) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	location = resolveLocation(resp.Request.URL.String(), location)
+	if resp, err := imagePush.checkRequest(http.MethodDelete, location, nil, token, ""); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// checkRequest 检查时使用的请求，token 为空时使用 basic auth
+func (imagePush *ImagePush) checkRequest(method, location string, body []byte, token, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(imagePush.ctx, method, location, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if imagePush.username != "" {
+		req.SetBasicAuth(imagePush.username, imagePush.password)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return imagePush.httpClient.Do(req)
+}
+
+// requestToken 按 docker token 协议获取 token，没有配置账号时获取匿名 token
+func (imagePush *ImagePush) requestToken(realm, service, scope string) (string, int, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", 0, err
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	// 跨仓库挂载时 scope 包含两个仓库，用空格分隔，按协议拆成多个 scope 参数
+	for _, s := range strings.Fields(scope) {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+	resp, err := imagePush.checkRequest(http.MethodGet, u.String(), nil, "", "")
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("invalid token response: %v", err)
+	}
+	if result.Token == "" {
+		result.Token = result.AccessToken
+	}
+	if result.Token == "" {
+		return "", resp.StatusCode, errors.New("empty token in response")
+	}
+	return result.Token, resp.StatusCode, nil
+}
+
+// parseChallenge 解析 Www-Authenticate，返回小写的认证方式和参数
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", params
+	}
+	scheme, rest, _ := strings.Cut(header, " ")
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[strings.ToLower(strings.TrimSpace(key))] = value[1:]
+				break
+			}
+			params[strings.ToLower(strings.TrimSpace(key))] = value[1 : end+1]
+			rest = value[end+2:]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return strings.ToLower(scheme), params
+}
+
+// tokenActions 从 JWT 格式的 token 里读取对仓库授予的权限，token 不是 JWT 时返回 false
+func tokenActions(token, repository string) ([]string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var claims struct {
+		Access *[]struct {
+			Type    string   `json:"type"`
+			Name    string   `json:"name"`
+			Actions []string `json:"actions"`
+		} `json:"access"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Access == nil {
+		return nil, false
+	}
+	actions := []string{}
+	for _, access := range *claims.Access {
+		if access.Type == "repository" && access.Name == repository {
+			actions = append(actions, access.Actions...)
+		}
+	}
+	return actions, true
+}
+
+// verifyCertificate 使用系统 CA 验证仓库的证书
+func verifyCertificate(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// describeConnError 把连接错误转换成便于排查的说明
+func describeConnError(err error, scheme string) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "certificate signed by an unknown authority, configure the CA certificate of the registry or skip SSL verify"
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("certificate is not valid for this host: %v", hostname.Error())
+	case errors.As(err, &invalid):
+		return fmt.Sprintf("invalid certificate: %v", invalid.Error())
+	case errors.As(err, &recordHeader) || (scheme == "https" && strings.Contains(err.Error(), "server gave HTTP response")):
+		return "the server speaks plain HTTP, use http:// in the registry url"
+	}
+	return fmt.Sprintf("can not connect: %v", err)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package push
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventType 推送过程中的事件类型
+type EventType string
+
+const (
+	EventPushStarted  EventType = "push_started"  // 开始推送一个镜像包
+	EventPushFinished EventType = "push_finished" // 镜像包推送结束，Err 不为空时表示失败
+	EventImagePushed  EventType = "image_pushed"  // 一个镜像推送结束，Err 不为空时表示失败
+	EventBlobUploaded EventType = "blob_uploaded" // 上传了一个 layer/config，Bytes 为大小
+	EventBlobSkipped  EventType = "blob_skipped"  // 仓库里已经存在，跳过上传
+	EventRequest      EventType = "request"       // 请求了一次镜像仓库
+	EventRetry        EventType = "retry"         // 认证失败后重试请求
+	EventToken        EventType = "token"         // 获取了一次 token
+)
+
+// Event 推送引擎发出的事件，用于统计指标等
+type Event struct {
+	Type       EventType
+	Registry   string
+	Repository string
+	Method     string
+	StatusCode int
+	Bytes      int64
+	Duration   time.Duration
+	Err        error
+}
+
+// Observer 事件的接收者，在推送的 goroutine 里同步调用，不能阻塞
+type Observer func(Event)
+
+var (
+	observersMu sync.RWMutex
+	observers   []Observer
+)
+
+// AddObserver 注册全局的事件接收者，所有推送都会通知
+func AddObserver(o Observer) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	observers = append(observers, o)
+}
+
+func (imagePush *ImagePush) emit(e Event) {
+	e.Registry = imagePush.registryEndpoint
+	emit(e)
+}
+
+func emit(e Event) {
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	for _, o := range observers {
+		o(e)
+	}
+}
+
+// observedTransport 记录每次请求镜像仓库的状态码和耗时
+type observedTransport struct {
+	base     http.RoundTripper
+	registry string
+}
+
+func (t *observedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	e := Event{Type: EventRequest, Registry: t.registry, Method: req.Method, Duration: time.Since(start), Err: err}
+	if resp != nil {
+		e.StatusCode = resp.StatusCode
+	}
+	emit(e)
+	return resp, err
+}
@@ -0,0 +1,137 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockFormat digest 锁定文件的格式
+type LockFormat string
+
+const (
+	LockJSON      LockFormat = "json"
+	LockYAML      LockFormat = "yaml"
+	LockKustomize LockFormat = "kustomize" // kustomization.yaml 的 images
+)
+
+// ParseLockFormat 解析锁定文件的格式，为空时按文件扩展名选择，.json 为 JSON，其他为 YAML
+func ParseLockFormat(format, file string) (LockFormat, error) {
+	switch LockFormat(strings.ToLower(format)) {
+	case "":
+		if strings.EqualFold(filepath.Ext(file), ".json") {
+			return LockJSON, nil
+		}
+		return LockYAML, nil
+	case LockJSON:
+		return LockJSON, nil
+	case LockYAML, "yml":
+		return LockYAML, nil
+	case LockKustomize:
+		return LockKustomize, nil
+	}
+	return "", fmt.Errorf("unknown lock format %q, must be json, yaml or kustomize", format)
+}
+
+// LockEntry 一个推送成功的镜像，Ref 为带 digest 的完整地址，用于在部署文件里固定镜像
+type LockEntry struct {
+	Source string `json:"source,omitempty" yaml:"source,omitempty"` // 镜像包里的镜像，例如 nginx:1.25
+	Image  string `json:"image" yaml:"image"`                       // 推送到的镜像，例如 harbor.example.com/library/nginx
+	Tag    string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Digest string `json:"digest" yaml:"digest"`
+	Ref    string `json:"ref" yaml:"ref"` // image@digest
+}
+
+// Lock digest 锁定文件
+type Lock struct {
+	Images []LockEntry `json:"images" yaml:"images"`
+}
+
+// NewLock 按推送结果生成锁定文件，失败的镜像不包含在内
+func NewLock(registry string, results []Result) *Lock {
+	host := registry
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	lock := &Lock{Images: []LockEntry{}}
+	for _, result := range results {
+		if result.Error != "" || result.Repository == "" || result.Digest == "" {
+			continue
+		}
+		image := path.Join(host, result.Repository)
+		lock.Images = append(lock.Images, LockEntry{
+			Source: result.Source,
+			Image:  image,
+			Tag:    result.Tag,
+			Digest: result.Digest,
+			Ref:    image + "@" + result.Digest,
+		})
+	}
+	return lock
+}
+
+// kustomizeImage kustomization.yaml 里 images 的一项，部署文件里的 name 替换成 newName@digest
+type kustomizeImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName"`
+	Digest  string `yaml:"digest"`
+}
+
+// Write 按格式写出锁定文件
+func (lock *Lock) Write(w io.Writer, format LockFormat) error {
+	switch format {
+	case LockJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(lock)
+	case LockYAML:
+		return encodeYAML(w, lock)
+	case LockKustomize:
+		images, err := lock.kustomize()
+		if err != nil {
+			return err
+		}
+		return encodeYAML(w, map[string][]kustomizeImage{"images": images})
+	}
+	return fmt.Errorf("unknown lock format %q", format)
+}
+
+// encodeYAML 和 kustomization.yaml 一样使用两个空格缩进
+func encodeYAML(w io.Writer, v interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// kustomize 按部署文件里的镜像名（镜像包里的镜像去掉 tag）合并，同一个镜像名只能固定到一个 digest
+func (lock *Lock) kustomize() ([]kustomizeImage, error) {
+	images := []kustomizeImage{}
+	index := map[string]int{}
+	for _, entry := range lock.Images {
+		// 没有 tag 的镜像包没有原来的镜像名，部署文件里直接使用推送后的镜像名
+		name := entry.Image
+		if ref, err := util.ParseReference(entry.Source); err == nil {
+			name = path.Join(ref.Registry, ref.Repository)
+		}
+		if i, ok := index[name]; ok {
+			if images[i].Digest != entry.Digest || images[i].NewName != entry.Image {
+				return nil, fmt.Errorf("kustomize images can not pin %s to both %s@%s and %s", name, images[i].NewName, images[i].Digest, entry.Ref)
+			}
+			continue
+		}
+		index[name] = len(images)
+		images = append(images, kustomizeImage{Name: name, NewName: entry.Image, Digest: entry.Digest})
+	}
+	return images, nil
+}
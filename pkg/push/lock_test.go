@@ -0,0 +1,140 @@
+package push
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testDigestA = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testDigestB = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestNewLock(t *testing.T) {
+	lock := NewLock("https://harbor.example.com/", []Result{
+		{Source: "nginx:1.25", Repository: "library/nginx", Tag: "1.25", Digest: testDigestA},
+		{Source: "redis:7", Repository: "library/redis", Tag: "7", Error: "push failed"},
+		{Repository: "library/app", Digest: testDigestB},
+		{Source: "busybox:1", Repository: "library/busybox"},
+	})
+	want := []LockEntry{
+		{Source: "nginx:1.25", Image: "harbor.example.com/library/nginx", Tag: "1.25", Digest: testDigestA, Ref: "harbor.example.com/library/nginx@" + testDigestA},
+		{Image: "harbor.example.com/library/app", Digest: testDigestB, Ref: "harbor.example.com/library/app@" + testDigestB},
+	}
+	if !reflect.DeepEqual(lock.Images, want) {
+		t.Errorf("NewLock() = %+v, want %+v", lock.Images, want)
+	}
+}
+
+func TestLockKustomize(t *testing.T) {
+	entry := func(source, image, digest string) LockEntry {
+		return LockEntry{Source: source, Image: image, Digest: digest, Ref: image + "@" + digest}
+	}
+	tests := []struct {
+		name    string
+		images  []LockEntry
+		want    []kustomizeImage
+		wantErr bool
+	}{
+		{
+			name:   "name from source",
+			images: []LockEntry{entry("nginx:1.25", "harbor.example.com/library/nginx", testDigestA)},
+			want:   []kustomizeImage{{Name: "nginx", NewName: "harbor.example.com/library/nginx", Digest: testDigestA}},
+		},
+		{
+			name:   "source with registry",
+			images: []LockEntry{entry("docker.io/library/redis:7", "harbor.example.com/library/redis", testDigestA)},
+			want:   []kustomizeImage{{Name: "docker.io/library/redis", NewName: "harbor.example.com/library/redis", Digest: testDigestA}},
+		},
+		{
+			name:   "untagged archive falls back to image",
+			images: []LockEntry{entry("", "harbor.example.com/library/app", testDigestB)},
+			want:   []kustomizeImage{{Name: "harbor.example.com/library/app", NewName: "harbor.example.com/library/app", Digest: testDigestB}},
+		},
+		{
+			name: "same image and digest merged",
+			images: []LockEntry{
+				entry("nginx:1.25", "harbor.example.com/library/nginx", testDigestA),
+				entry("nginx:stable", "harbor.example.com/library/nginx", testDigestA),
+			},
+			want: []kustomizeImage{{Name: "nginx", NewName: "harbor.example.com/library/nginx", Digest: testDigestA}},
+		},
+		{
+			name: "different digests conflict",
+			images: []LockEntry{
+				entry("nginx:1.25", "harbor.example.com/library/nginx", testDigestA),
+				entry("nginx:1.26", "harbor.example.com/library/nginx", testDigestB),
+			},
+			wantErr: true,
+		},
+		{
+			name: "different targets conflict",
+			images: []LockEntry{
+				entry("nginx:1.25", "harbor.example.com/library/nginx", testDigestA),
+				entry("nginx:1.25", "harbor.example.com/mirror/nginx", testDigestA),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		lock := &Lock{Images: tt.images}
+		got, err := lock.kustomize()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: kustomize() = %+v, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: kustomize() error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kustomize() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLockWriteKustomize(t *testing.T) {
+	lock := &Lock{Images: []LockEntry{
+		{Source: "nginx:1.25", Image: "harbor.example.com/library/nginx", Digest: testDigestA},
+	}}
+	var buf bytes.Buffer
+	if err := lock.Write(&buf, LockKustomize); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	want := strings.Join([]string{
+		"images:",
+		"  - name: nginx",
+		"    newName: harbor.example.com/library/nginx",
+		"    digest: " + testDigestA,
+		"",
+	}, "\n")
+	if buf.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestParseLockFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		file    string
+		want    LockFormat
+		wantErr bool
+	}{
+		{"", "images.lock.json", LockJSON, false},
+		{"", "images.lock.yaml", LockYAML, false},
+		{"", "-", LockYAML, false},
+		{"YML", "images.json", LockYAML, false},
+		{"kustomize", "kustomization.yaml", LockKustomize, false},
+		{"toml", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLockFormat(tt.format, tt.file)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLockFormat(%q, %q) = %q, %v, want %q, wantErr %v", tt.format, tt.file, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
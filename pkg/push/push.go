@@ -2,10 +2,13 @@ package push
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,14 +16,14 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"docker-tar-push-ui/pkg/util"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/schema2"
-	"github.com/mholt/archiver/v3"
-	"github.com/olahol/melody"
 	"github.com/opencontainers/go-digest"
 	"github.com/silenceper/log"
 )
@@ -33,13 +36,49 @@ type ImagePush struct {
 	skipSSLVerify    bool
 	tmpDir           string
 	httpClient       *http.Client
-	imagePrefix      string // 指定镜像仓库名称
-	session          *melody.Session
+	imagePrefix      string    // 指定镜像仓库名称
+	out              io.Writer // 推送日志同时写到这里，例如 WebSocket 终端、任务日志
 	authToken        string
+	tag              *util.Reference               // 替换镜像包里的 tag（和镜像名）
+	extraTags        []string                      // 推送完成后额外加上的 tag，不重新上传 layer
+	digestOnly       bool                          // 只按 digest 推送 manifest，不产生 tag
+	authorize        func(repository string) error // 推送前检查是否有权限推送到仓库
+	results          []Result
+	limiters         []*util.RateLimiter // 上传 blob 时的限速
+	uploadStrategy   UploadStrategy
+	chunkSize        int64
+	workingStrategy  UploadStrategy // 自动选择时已经成功过的上传方式
+	rangePrefix      string         // 分片上传时 Content-Range 的前缀，有的仓库要求 "bytes="
+	stopped          atomic.Bool
+	canceled         atomic.Bool
+
+	// ctx 推送过程中所有请求都使用这个 context，Stop、Cancel 时取消，正在进行的请求会立即中断
+	ctx     context.Context
+	mu      sync.Mutex
+	abortFn context.CancelCauseFunc
 }
 
-// NewImagePush new
-func NewImagePush(archivePath, registryEndpoint, imagePrefix, username, password string, skipSSLVerify bool, s *melody.Session) *ImagePush {
+// 推送中断的原因
+var (
+	ErrStopped  = errors.New("服务正在停止，镜像停止上传")
+	ErrCanceled = errors.New("任务中止，镜像停止上传")
+)
+
+// TmpRoot 解压镜像包的临时目录，每次推送一个子目录，推送结束后删除
+var TmpRoot = "./tmp/docker-tar-push"
+
+// Result 一个镜像（或者解析失败的镜像包）的推送结果
+type Result struct {
+	Archive    string `json:"archive"`
+	Source     string `json:"source,omitempty"` // 镜像包里的镜像，例如 nginx:1.25，没有 tag 的镜像为空
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewImagePush new，out 为 nil 时日志只打印到标准输出
+func NewImagePush(archivePath, registryEndpoint, imagePrefix, username, password string, skipSSLVerify bool, out io.Writer) *ImagePush {
 	registryEndpoint = strings.TrimSuffix(registryEndpoint, "/")
 	// registryEndpoint 如果没有协议，则默认添加https://
 	if !strings.HasPrefix(registryEndpoint, "http://") && !strings.HasPrefix(registryEndpoint, "https://") {
@@ -55,11 +94,118 @@ func NewImagePush(archivePath, registryEndpoint, imagePrefix, username, password
 		password:         password,
 		skipSSLVerify:    skipSSLVerify,
 		tmpDir:           "./tmp/",
-		httpClient:       &http.Client{Transport: tr},
+		httpClient:       &http.Client{Transport: &observedTransport{base: tr, registry: registryEndpoint}},
 		imagePrefix:      imagePrefix,
-		// 用于跟前端实时推送日志的ws session
-		session: s,
+		out:              out,
+		uploadStrategy:   UploadAuto,
+		chunkSize:        DefaultChunkSize,
+		ctx:              context.Background(),
+	}
+}
+
+// SetCACert 信任自签名证书的 CA（PEM），跳过 SSL 验证时不需要
+func (imagePush *ImagePush) SetCACert(caCert []byte) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("invalid ca certificate")
+	}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: imagePush.skipSSLVerify, RootCAs: pool},
 	}
+	imagePush.httpClient.Transport = &observedTransport{base: tr, registry: imagePush.registryEndpoint}
+	return nil
+}
+
+// SetAuthorizer 设置仓库权限检查，每个镜像推送之前都会检查一次
+func (imagePush *ImagePush) SetAuthorizer(authorize func(repository string) error) {
+	imagePush.authorize = authorize
+}
+
+// ParseTag 解析推送时替换的 tag，例如 1.0 或者 app:1.0，为空时返回 nil
+func ParseTag(s string) (*util.Reference, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ref, err := util.ParseTagTarget(&util.Reference{}, s)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Registry != "" {
+		return nil, fmt.Errorf("%s: registry is not allowed in tag, use --registry", s)
+	}
+	return ref, nil
+}
+
+// SetTag 推送时替换镜像包里的 tag；带镜像名时同时替换镜像名，镜像包里没有 tag 的镜像也可以推送
+func (imagePush *ImagePush) SetTag(tag *util.Reference) {
+	imagePush.tag = tag
+}
+
+// SetDigestOnly 只按 digest 推送 manifest，不产生 tag，额外的 tag 不会推送
+func (imagePush *ImagePush) SetDigestOnly(digestOnly bool) {
+	imagePush.digestOnly = digestOnly
+}
+
+// SetExtraTags 每个镜像推送完成后，把同一个 manifest 再推送到这些 tag，例如 latest
+func (imagePush *ImagePush) SetExtraTags(tags []string) {
+	imagePush.extraTags = tags
+}
+
+// pushExtraTags 把已经推送的 manifest 推送到额外的 tag，layer 已经在仓库里，只需要 PUT manifest
+func (imagePush *ImagePush) pushExtraTags(archive *util.Archive, source, repoImage string, manifestData []byte, tagged map[string]bool) {
+	for _, tag := range imagePush.extraTags {
+		if tagged[repoImage+":"+tag] {
+			continue
+		}
+		manifestDigest, err := imagePush.putManifest(repoImage, tag, manifestData, schema2.MediaTypeManifest)
+		if err != nil {
+			err = imagePush.interrupted(err)
+		}
+		imagePush.addResult(archive, source, repoImage, tag, manifestDigest, err)
+		if err != nil {
+			imagePush.Errorf("push extra tag %s:%s error,%+v", repoImage, tag, err)
+			continue
+		}
+		tagged[repoImage+":"+tag] = true
+		imagePush.Infof("push extra tag %s:%s done, digest: %s", repoImage, tag, manifestDigest)
+	}
+}
+
+// SetRateLimiters 上传 blob 时同时受这些限速器的限制，例如全局带宽和单个任务的带宽
+func (imagePush *ImagePush) SetRateLimiters(limiters ...*util.RateLimiter) {
+	imagePush.limiters = limiters
+}
+
+// blobBody 上传一个分片的请求体，经过限速
+func (imagePush *ImagePush) blobBody(chunk []byte) io.Reader {
+	return imagePush.blobReader(bytes.NewReader(chunk))
+}
+
+// bandwidthLimit 当前生效的限速，即所有限速器里最小的那个，0 表示不限速
+func (imagePush *ImagePush) bandwidthLimit() int64 {
+	var limit int64
+	for _, l := range imagePush.limiters {
+		if n := l.Limit(); n > 0 && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// progress 打印 blob 的上传进度和实际的上传速度
+func (imagePush *ImagePush) progress(file string, offset, size, sent int64, start time.Time) {
+	percent := 100.0
+	if size > 0 {
+		percent = float64(offset) * 100 / float64(size)
+	}
+	speed := util.FormatSize(int64(float64(sent)/time.Since(start).Seconds())) + "/s"
+	if limit := imagePush.bandwidthLimit(); limit > 0 {
+		speed += " (limit " + util.FormatRate(limit) + ")"
+	}
+	imagePush.Infof("Pushing %s ... %.2f%% %s", file, percent, speed)
 }
 
 // Manifest manifest.json
@@ -72,46 +218,96 @@ type Manifest struct {
 // 用于跟前端实时推送日志的log实现
 func (imagePush *ImagePush) Errorf(format string, v ...interface{}) {
 	log.Errorf(format, v...)
-	if imagePush.session != nil && !imagePush.session.IsClosed() {
-		imagePush.session.Write([]byte("[ERROR] " + fmt.Sprintf(format, v...) + "\n"))
+	if imagePush.out != nil {
+		imagePush.out.Write([]byte("[ERROR] " + fmt.Sprintf(format, v...) + "\n"))
 	}
 }
 
 func (imagePush *ImagePush) Infof(format string, v ...interface{}) {
 	log.Infof(format, v...)
-	if imagePush.session != nil && !imagePush.session.IsClosed() {
-		imagePush.session.Write([]byte("[INFO] " + fmt.Sprintf(format, v...) + "\n"))
+	if imagePush.out != nil {
+		imagePush.out.Write([]byte("[INFO] " + fmt.Sprintf(format, v...) + "\n"))
 	}
 }
 
 func (imagePush *ImagePush) Debugf(format string, v ...interface{}) {
 	log.Debugf(format, v...)
 	// Debug暂时不打印到界面
-	// if imagePush.session != nil && !imagePush.session.IsClosed() {
-	// 	imagePush.session.Write([]byte("[DEBUG] " + fmt.Sprintf(format, v...) + "\n"))
+	// if imagePush.out != nil {
+	// 	imagePush.out.Write([]byte("[DEBUG] " + fmt.Sprintf(format, v...) + "\n"))
 	// }
 }
 
-// Push push archive image
-func (imagePush *ImagePush) Push() {
-	//判断tar包是否正常
-	if !util.Exists(imagePush.archivePath) {
-		imagePush.Errorf("%s not exists", imagePush.archivePath)
-		return
-	}
-	imageFiles, err := util.FilesPath(imagePush.archivePath)
+// Push push archive image，ctx 取消时中断正在进行的请求
+func (imagePush *ImagePush) Push(ctx context.Context) {
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	imagePush.mu.Lock()
+	imagePush.ctx, imagePush.abortFn = ctx, abort
+	imagePush.mu.Unlock()
+	// Push 之前已经被停止或者取消
+	if imagePush.stopped.Load() {
+		abort(ErrStopped)
+	} else if imagePush.canceled.Load() {
+		abort(ErrCanceled)
+	}
+
+	start := time.Now()
+	imagePush.emit(Event{Type: EventPushStarted})
+	defer func() {
+		var err error
+		for _, result := range imagePush.results {
+			if result.Error != "" {
+				err = errors.New(result.Error)
+			}
+		}
+		imagePush.emit(Event{Type: EventPushFinished, Duration: time.Since(start), Err: err})
+	}()
+	//判断tar包是否正常，分卷包会被归并成一个镜像包
+	archives, err := util.FindArchives(imagePush.archivePath)
 	if err != nil {
 		imagePush.Errorf("get image FilesPath err: %v", err)
+		imagePush.results = append(imagePush.results, Result{Archive: path.Base(imagePush.archivePath), Error: err.Error()})
 		return
 	}
-	for _, imagepath := range imageFiles {
-		imagePush.preHandle(imagepath)
+	for _, archive := range archives {
+		if err := imagePush.checkTaskProgress(); err != nil {
+			imagePush.addResult(archive, "", "", "", "", err)
+			continue
+		}
+		n := len(imagePush.results)
+		if err := imagePush.preHandle(archive); err != nil && len(imagePush.results) == n {
+			// 镜像包本身解析失败，还没有开始推送镜像
+			imagePush.addResult(archive, "", "", "", "", err)
+		}
+	}
+}
+
+// Results 推送结果，Push 返回后调用
+func (imagePush *ImagePush) Results() []Result {
+	return imagePush.results
+}
+
+// Registry 镜像仓库地址
+func (imagePush *ImagePush) Registry() string {
+	return imagePush.registryEndpoint
+}
+
+func (imagePush *ImagePush) addResult(archive *util.Archive, source, repository, tag, digest string, err error) {
+	result := Result{Archive: archive.Name, Source: source, Repository: repository, Tag: tag, Digest: digest}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	imagePush.results = append(imagePush.results, result)
+	if repository != "" {
+		imagePush.emit(Event{Type: EventImagePushed, Repository: repository, Err: err})
 	}
 }
 
 // push预先处理
-func (imagePush *ImagePush) preHandle(imagepath string) error {
-	imagePush.tmpDir = fmt.Sprintf("./tmp/docker-tar-push/%d", time.Now().UnixNano())
+func (imagePush *ImagePush) preHandle(archive *util.Archive) error {
+	imagepath := archive.Path
+	imagePush.tmpDir = path.Join(TmpRoot, fmt.Sprint(time.Now().UnixNano()))
 	imagePush.Infof("extract archive file %s to %s", imagepath, imagePush.tmpDir)
 
 	defer func() {
@@ -121,17 +317,14 @@ func (imagePush *ImagePush) preHandle(imagepath string) error {
 		}
 	}()
 
-	err := archiver.Unarchive(imagepath, imagePush.tmpDir)
-	if err != nil {
-		// imagePush.Errorf("tar unarchive failed, %+v", err)
-		imagePush.Infof("use gzip unarchive file %s to %s", imagepath, imagePush.tmpDir)
+	if archive.Split {
+		// 分卷包按顺序拼成一个数据流解压
+		imagePush.Infof("archive %s has %d parts", imagepath, len(archive.Parts))
 	}
-	// gzip 解压
-	if err != nil {
-		if err = util.Decompress(imagepath, imagePush.tmpDir); err != nil {
-			imagePush.Errorf("gzip unarchive failed, %+v", err)
-			return err
-		}
+	// 解压 tar/tar.gz，所有文件都只能写到临时目录内
+	if err := util.ExtractArchive(archive, imagePush.tmpDir); err != nil {
+		imagePush.Errorf("unarchive %s failed, %+v", imagepath, err)
+		return err
 	}
 
 	// 封装image
@@ -146,64 +339,197 @@ func (imagePush *ImagePush) preHandle(imagepath string) error {
 		imagePush.Errorf("unmarshal manifest.json failed, %+v", err)
 		return err
 	}
-
+	// manifest.json 里引用的文件也必须在临时目录内，防止把服务器上的其他文件推送出去
 	for _, manifestObj := range manifestObjs {
+		for _, file := range append([]string{manifestObj.Config}, manifestObj.Layers...) {
+			if _, err := util.SafeJoin(imagePush.tmpDir, file); err != nil {
+				imagePush.Errorf("invalid manifest.json, %+v", err)
+				return err
+			}
+		}
+	}
+
+	// 推送之前解析所有镜像的名称和 tag，有问题时整个镜像包都不推送
+	targets := make([][]pushTarget, len(manifestObjs))
+	for i, manifestObj := range manifestObjs {
+		if targets[i], err = imagePush.imageTargets(manifestObj, len(manifestObjs)); err != nil {
+			imagePush.Errorf("%v", err)
+			return err
+		}
+	}
+
+	for i, manifestObj := range manifestObjs {
 		imagePush.Infof("start push image archive %s", imagePush.archivePath)
-		for _, repo := range manifestObj.RepoTags {
-			//repo = "xxxxxx/test-tar:test-tag"
-			image, tag := util.ParseImageAndTag(repo)
-			// image := "xxxxx/xxxxxxx/test-tar" 只保留最后部分test-tar
-			image = path.Base(image)
-			repoImage := path.Join(imagePush.imagePrefix, image)
-			imagePush.Debugf("image=%s,tag=%s", image, tag)
-
-			//push layer
-			var layerPaths []string
-			for _, layer := range manifestObj.Layers {
-				if err := imagePush.checkTaskProgress(); err != nil {
-					return err
-				}
-				layerPath := path.Join(imagePush.tmpDir, layer)
-				err = imagePush.pushLayer(layer, repoImage)
-				if err != nil {
-					imagePush.Errorf("pushLayer %s Failed, %v", layer, err)
+		tagged := map[string]bool{} // 已经推送过的 镜像:tag，额外的 tag 和镜像包里的 tag 相同时不重复推送
+		for _, target := range targets[i] {
+			source, repoImage, tag := target.Source, target.Repository, target.Tag
+			imagePush.Debugf("image=%s,tag=%s", repoImage, tag)
+			if imagePush.authorize != nil {
+				if err := imagePush.authorize(repoImage); err != nil {
+					imagePush.Errorf("push %s:%s denied, %v", repoImage, tag, err)
+					imagePush.addResult(archive, source, repoImage, tag, "", err)
 					return err
 				}
-				layerPaths = append(layerPaths, layerPath)
-			}
-			if err := imagePush.checkTaskProgress(); err != nil {
-				return err
 			}
-			//push image config
-			err = imagePush.pushConfig(manifestObj.Config, repoImage)
+
+			layerPaths, err := imagePush.pushBlobs(manifestObj, repoImage)
 			if err != nil {
-				imagePush.Errorf("push image config failed,%+v", err)
-				return err
-			}
-			if err := imagePush.checkTaskProgress(); err != nil {
+				imagePush.addResult(archive, source, repoImage, tag, "", err)
 				return err
 			}
 			//push manifest
 			imagePush.Infof("start push manifest")
-			err = imagePush.pushManifest(layerPaths, manifestObj.Config, repoImage, tag)
+			manifestData, err := imagePush.buildManifest(layerPaths, manifestObj.Config)
+			var manifestDigest string
+			if err == nil {
+				// 只按 digest 推送时不产生 tag，manifest 只能通过 digest 拉取
+				reference := tag
+				if imagePush.digestOnly {
+					reference = digest.FromBytes(manifestData).String()
+				}
+				manifestDigest, err = imagePush.putManifest(repoImage, reference, manifestData, schema2.MediaTypeManifest)
+			}
+			if err != nil {
+				err = imagePush.interrupted(err)
+			}
+			imagePush.addResult(archive, source, repoImage, tag, manifestDigest, err)
 			if err != nil {
 				imagePush.Errorf("push manifest error,%+v", err)
+				continue
+			}
+			imagePush.Infof("push manifest done, digest: %s", manifestDigest)
+			if !imagePush.digestOnly {
+				tagged[repoImage+":"+tag] = true
+				imagePush.pushExtraTags(archive, source, repoImage, manifestData, tagged)
 			}
-			imagePush.Infof("push manifest done")
 		}
 	}
 	imagePush.Infof("push image archive %s done\n\n", imagepath)
 	return nil
 }
 
+// pushTarget 镜像包里的一个镜像推送到的 镜像:tag
+type pushTarget struct {
+	Source     string // 镜像包里的镜像（RepoTags），没有 tag 的镜像为空
+	Repository string
+	Tag        string // 只按 digest 推送时为空
+}
+
+// imageTargets 镜像推送到的 镜像:tag，镜像名只保留 RepoTags 的最后一段加上镜像前缀，没有 tag 时使用 latest
+// 指定了 --tag 时替换 tag，--tag 带镜像名时（只能用于只有一个镜像的镜像包）同时替换镜像名
+func (imagePush *ImagePush) imageTargets(manifestObj *Manifest, images int) ([]pushTarget, error) {
+	var targets []pushTarget
+	seen := map[string]bool{}
+	add := func(source, repository, tag string) {
+		if imagePush.digestOnly {
+			tag = ""
+		}
+		if !seen[repository+":"+tag] {
+			seen[repository+":"+tag] = true
+			targets = append(targets, pushTarget{Source: source, Repository: repository, Tag: tag})
+		}
+	}
+	override := imagePush.tag
+	if override != nil && override.Repository != "" {
+		if images > 1 {
+			return nil, fmt.Errorf("the archive has %d images, --tag %s can only set the tag, not the image name", images, override)
+		}
+		source := ""
+		if len(manifestObj.RepoTags) > 0 {
+			source = manifestObj.RepoTags[0]
+		}
+		add(source, path.Join(imagePush.imagePrefix, override.Repository), override.Tag)
+		return targets, nil
+	}
+	for _, repo := range manifestObj.RepoTags {
+		// repo 例如 harbor.example.com:5000/library/nginx:1.25，只保留 nginx
+		ref, err := util.ParseReference(repo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RepoTags of image %s in manifest.json: %v", manifestObj.Config, err)
+		}
+		tag := ref.Tag
+		if override != nil {
+			tag = override.Tag
+		} else if tag == "" {
+			tag = "latest"
+		}
+		add(repo, path.Join(imagePush.imagePrefix, path.Base(ref.Repository)), tag)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("image %s has no RepoTags in manifest.json (saved by image id?), use --tag name:tag to push it", manifestObj.Config)
+	}
+	return targets, nil
+}
+
 // 检查当前任务是否正在运行
-func (imagePush *ImagePush) checkTaskProgress() error {
-	if imagePush.session != nil {
-		if inProgress, exists := imagePush.session.Get("taskInProgress"); exists && !inProgress.(bool) {
-			return fmt.Errorf("任务中止，镜像停止上传")
+// pushBlobs 推送镜像的 layer 和 config，返回 layer 的本地路径
+func (imagePush *ImagePush) pushBlobs(manifestObj *Manifest, repoImage string) ([]string, error) {
+	var layerPaths []string
+	for _, layer := range manifestObj.Layers {
+		if err := imagePush.checkTaskProgress(); err != nil {
+			return nil, err
+		}
+		layerPath := path.Join(imagePush.tmpDir, layer)
+		err := imagePush.pushLayer(layer, repoImage)
+		if err != nil {
+			err = imagePush.interrupted(err)
+			imagePush.Errorf("pushLayer %s Failed, %v", layer, err)
+			return nil, err
 		}
+		layerPaths = append(layerPaths, layerPath)
 	}
-	return nil
+	if err := imagePush.checkTaskProgress(); err != nil {
+		return nil, err
+	}
+	//push image config
+	err := imagePush.pushConfig(manifestObj.Config, repoImage)
+	if err != nil {
+		err = imagePush.interrupted(err)
+		imagePush.Errorf("push image config failed,%+v", err)
+		return nil, err
+	}
+	if err := imagePush.checkTaskProgress(); err != nil {
+		return nil, err
+	}
+	return layerPaths, nil
+}
+
+// Stop 停止推送，正在进行的请求会立即中断，已经推送的 layer 下次推送时会跳过
+func (imagePush *ImagePush) Stop() {
+	imagePush.stopped.Store(true)
+	imagePush.abort(ErrStopped)
+}
+
+// Cancel 用户取消推送，跟 Stop 一样中断正在进行的请求
+func (imagePush *ImagePush) Cancel() {
+	imagePush.canceled.Store(true)
+	imagePush.abort(ErrCanceled)
+}
+
+// Canceled 推送是否被用户取消
+func (imagePush *ImagePush) Canceled() bool {
+	return imagePush.canceled.Load()
+}
+
+func (imagePush *ImagePush) abort(cause error) {
+	imagePush.mu.Lock()
+	defer imagePush.mu.Unlock()
+	if imagePush.abortFn != nil {
+		imagePush.abortFn(cause)
+	}
+}
+
+// checkTaskProgress 推送被停止或者取消时返回原因
+func (imagePush *ImagePush) checkTaskProgress() error {
+	return context.Cause(imagePush.ctx)
+}
+
+// interrupted 请求因为推送被停止或者取消而失败时，返回停止的原因
+func (imagePush *ImagePush) interrupted(err error) error {
+	if cause := context.Cause(imagePush.ctx); cause != nil {
+		return cause
+	}
+	return err
 }
 
 func (imagePush *ImagePush) checkLayerExist(file, image string) (bool, error) {
@@ -218,7 +544,7 @@ func (imagePush *ImagePush) checkLayerExist(file, image string) (bool, error) {
 	log.Infof("Constructed URL: %s", url)
 
 	// 创建 HTTP 请求
-	req, err := http.NewRequest("HEAD", url, nil)
+	req, err := http.NewRequestWithContext(imagePush.ctx, "HEAD", url, nil)
 	if err != nil {
 		log.Errorf("Failed to create HTTP request: %v", err)
 		return false, err
@@ -247,16 +573,16 @@ func (imagePush *ImagePush) checkLayerExist(file, image string) (bool, error) {
 		authHeader := resp.Header.Get("Www-Authenticate")
 		if authHeader != "" {
 			log.Infof("Received Www-Authenticate header: %s", authHeader)
-			token, err := getToken(authHeader, imagePush.username, imagePush.password)
+			token, err := imagePush.fetchToken(authHeader)
 			if err != nil {
 				log.Errorf("Failed to get token: %v", err)
 				return false, err
 			}
-			imagePush.authToken = token
-			log.Infof("Successfully obtained token: %s", token)
+			log.Infof("Successfully obtained token")
 			// 使用 Token 重新发送请求
 			req.Header.Set("Authorization", "Bearer "+token)
 			log.Infof("Sending request with Bearer token...")
+			imagePush.emit(Event{Type: EventRetry, Method: req.Method})
 			resp, err = imagePush.httpClient.Do(req)
 			if err != nil {
 				log.Errorf("Failed to send request with Bearer token: %v", err)
@@ -282,7 +608,8 @@ func (imagePush *ImagePush) checkLayerExist(file, image string) (bool, error) {
 	}
 }
 
-func (imagePush *ImagePush) pushManifest(layersPaths []string, imageConfig, image, tag string) error {
+// buildManifest 按镜像包里的 config 和 layer 生成 schema2 的 manifest
+func (imagePush *ImagePush) buildManifest(layersPaths []string, imageConfig string) ([]byte, error) {
 	configPath := path.Join(imagePush.tmpDir, imageConfig)
 	obj := &schema2.Manifest{}
 	obj.SchemaVersion = schema2.SchemaVersion.SchemaVersion
@@ -290,22 +617,22 @@ func (imagePush *ImagePush) pushManifest(layersPaths []string, imageConfig, imag
 	obj.Config.MediaType = schema2.MediaTypeImageConfig
 	configSize, err := util.GetFileSize(configPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	obj.Config.Size = configSize
 	hash, err := util.Sha256Hash(configPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	obj.Config.Digest = digest.Digest("sha256:" + hash)
 	for _, layersPath := range layersPaths {
 		layerSize, err := util.GetFileSize(layersPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		hash, err := util.Sha256Hash(layersPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		item := distribution.Descriptor{
 			MediaType: schema2.MediaTypeUncompressedLayer,
@@ -314,38 +641,37 @@ func (imagePush *ImagePush) pushManifest(layersPaths []string, imageConfig, imag
 		}
 		obj.Layers = append(obj.Layers, item)
 	}
-	data, err := json.Marshal(obj)
-	if err != nil {
-		return err
-	}
-	url := fmt.Sprintf("%s/v2/%s/manifests/%s", imagePush.registryEndpoint, image, tag)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(data))
-	if err != nil {
-		imagePush.Errorf("push manifest request error,%+v", err)
-		return err
-	}
-	req.SetBasicAuth(imagePush.username, imagePush.password)
-	if imagePush.authToken != "" {
-		req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
-	}
+	return json.Marshal(obj)
+}
+
+// putManifest 把 manifest 推送到 image:reference，返回 manifest 的 digest
+// 内容不变时 digest 也不变，同一个 manifest 推送到多个 tag 不需要重新上传 layer
+func (imagePush *ImagePush) putManifest(image, reference string, data []byte, mediaType string) (string, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", imagePush.registryEndpoint, image, reference)
 	imagePush.Debugf("PUT %s", url)
-	req.Header.Set("Content-Type", schema2.MediaTypeManifest)
-	resp, err := imagePush.httpClient.Do(req)
+	resp, err := imagePush.registryRequest(http.MethodPut, url, data, func(req *http.Request) {
+		req.Header.Set("Content-Type", mediaType)
+	})
 	if err != nil {
-		imagePush.Errorf("push manifest post error,%+v", err)
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		imagePush.Errorf("read url /manifests/ body err: %v", err)
-		return err
+		return "", err
 	}
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("put manifest failed, code is %d, body: %v", resp.StatusCode, string(body))
+		return "", fmt.Errorf("put manifest failed, code is %d, body: %v", resp.StatusCode, string(body))
 	}
-	return nil
+	// 以仓库返回的 Docker-Content-Digest 为准，和本地计算的不一致时说明仓库转换了 manifest
+	canonical := digest.FromBytes(data).String()
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != canonical {
+		imagePush.Infof("registry returned digest %s for %s:%s, the manifest digest is %s, using the registry digest", d, image, reference, canonical)
+		return d, nil
+	}
+	return canonical, nil
 }
 
 func (imagePush *ImagePush) pushConfig(imageConfig, image string) error {
@@ -358,15 +684,16 @@ func (imagePush *ImagePush) pushConfig(imageConfig, image string) error {
 	}
 	if exist {
 		imagePush.Infof("%s Already exist", imageConfig)
+		imagePush.emitBlob(EventBlobSkipped, image, configPath)
 		return nil
 	}
 
 	imagePush.Infof("start push image config %s", imageConfig)
-	url, err := imagePush.startPushing(image)
-	if err != nil {
-		return fmt.Errorf("startPushing Error, %+v", err)
+	if err := imagePush.uploadBlob(configPath, image); err != nil {
+		return err
 	}
-	return imagePush.chunkUpload(configPath, url)
+	imagePush.emitBlob(EventBlobUploaded, image, configPath)
+	return nil
 }
 
 func (imagePush *ImagePush) pushLayer(layer, image string) error {
@@ -378,96 +705,129 @@ func (imagePush *ImagePush) pushLayer(layer, image string) error {
 	}
 	if exist {
 		imagePush.Infof("%s Already exist", layer)
+		imagePush.emitBlob(EventBlobSkipped, image, layerPath)
 		return nil
 	}
-	url, err := imagePush.startPushing(image)
-	if err != nil {
-		return fmt.Errorf("startPushing Error, %+v", err)
+	if err := imagePush.uploadBlob(layerPath, image); err != nil {
+		return err
 	}
-	return imagePush.chunkUpload(layerPath, url)
+	imagePush.emitBlob(EventBlobUploaded, image, layerPath)
+	return nil
 }
 
-func (imagePush *ImagePush) chunkUpload(file, url string) error {
-	imagePush.Debugf("push file %s to %s", file, url)
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	stat, err := f.Stat() //获取文件状态
+func (imagePush *ImagePush) emitBlob(t EventType, image, file string) {
+	size, _ := util.GetFileSize(file)
+	imagePush.emit(Event{Type: t, Repository: image, Bytes: size})
+}
+
+// chunkUpload 分片上传 blob，最后一片通过 PUT 带上 digest，失败或者被取消时删除仓库上未完成的上传
+func (imagePush *ImagePush) chunkUpload(file, location string) (err error) {
+	imagePush.Debugf("push file %s to %s", file, location)
+	defer func() {
+		if err != nil {
+			imagePush.deleteUpload(location)
+		}
+	}()
+	f, contentSize, err := openBlob(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	contentSize := stat.Size()
-	chunkSize := 2097152
-	index, offset := 0, 0
-	buf := make([]byte, chunkSize)
+	buf := make([]byte, imagePush.chunkSize)
 	h := sha256.New()
+	start, offset := time.Now(), int64(0)
 	for {
-		n, err := f.Read(buf)
-		if err == io.EOF {
-			break
+		if err := imagePush.checkTaskProgress(); err != nil {
+			return err
 		}
-		offset = index + n
-		index = offset
-		imagePush.Infof("Pushing %s ... %.2f%s", file, (float64(offset)/float64(contentSize))*100, "%")
-
-		chunk := buf[0:n]
-
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		chunk := buf[:n]
 		h.Write(chunk)
 
-		if int64(offset) == contentSize {
-			sum := h.Sum(nil)
+		// 最后一片（包括空文件）通过 PUT 完成上传
+		if offset+int64(n) >= contentSize {
 			//由于是十六进制表示，因此需要转换
-			hash := hex.EncodeToString(sum)
-			//last
-			req, err := http.NewRequest("PUT",
-				fmt.Sprintf("%s&digest=sha256:%s", url, hash), bytes.NewBuffer(chunk))
-			if err != nil {
-				return err
-			}
-			req.SetBasicAuth(imagePush.username, imagePush.password)
-			if imagePush.authToken != "" {
-				req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
-			}
-			imagePush.Debugf("PUT %s", url)
-			req.Header.Set("Content-Type", "application/octet-stream")
-			req.Header.Set("Content-Length", fmt.Sprintf("%d", n))
-			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", index, offset))
-			resp, err := imagePush.httpClient.Do(req)
+			hash := hex.EncodeToString(h.Sum(nil))
+			resp, err := imagePush.sendChunk(http.MethodPut, withDigest(location, hash), chunk, offset)
 			if err != nil {
 				return err
 			}
+			resp.Body.Close()
 			if resp.StatusCode != http.StatusCreated {
-				return fmt.Errorf("PUT chunk layer error,code is %d", resp.StatusCode)
-			}
-			break
-		} else {
-			req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(chunk))
-			if err != nil {
-				return err
-			}
-			req.SetBasicAuth(imagePush.username, imagePush.password)
-			if imagePush.authToken != "" {
-				req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
-			}
-			req.Header.Set("Content-Type", "application/octet-stream")
-			req.Header.Set("Content-Length", fmt.Sprintf("%d", n))
-			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", index, offset))
-			imagePush.Debugf("PATCH %s", url)
-			resp, err := imagePush.httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			location := resp.Header.Get("Location")
-			if resp.StatusCode == http.StatusAccepted && location != "" {
-				url = location
-			} else {
-				return fmt.Errorf("PATCH chunk file error,code is %d", resp.StatusCode)
+				return uploadError(resp, "PUT chunk layer")
 			}
+			imagePush.progress(file, contentSize, contentSize, contentSize, start)
+			return nil
+		}
+		resp, err := imagePush.sendChunk(http.MethodPatch, location, chunk, offset)
+		if err != nil {
+			return err
 		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return uploadError(resp, "PATCH chunk file")
+		}
+		location = nextLocation(resp, location)
+		offset += int64(n)
+		imagePush.progress(file, offset, contentSize, offset, start)
 	}
-	return nil
+}
+
+// sendChunk 上传 offset 开始的一个分片
+//
+// Content-Range 按规范是 "起始-结束"（包含结束位置），有的仓库只接受 "bytes=起始-结束"，
+// 第一个分片因为格式被拒绝时换一种格式重试，成功后后面的分片都使用这种格式
+func (imagePush *ImagePush) sendChunk(method, location string, chunk []byte, offset int64) (*http.Response, error) {
+	send := func(prefix string) (*http.Response, error) {
+		req, err := imagePush.blobRequest(method, location, imagePush.blobBody(chunk), int64(len(chunk)))
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) > 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("%s%d-%d", prefix, offset, offset+int64(len(chunk))-1))
+		}
+		imagePush.Debugf("%s %s", method, location)
+		return imagePush.httpClient.Do(req)
+	}
+	resp, err := send(imagePush.rangePrefix)
+	if err != nil || method != http.MethodPatch || offset != 0 ||
+		(resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable) {
+		return resp, err
+	}
+	resp.Body.Close()
+	prefix := "bytes="
+	if imagePush.rangePrefix != "" {
+		prefix = ""
+	}
+	imagePush.Debugf("PATCH rejected with code %d, retry with Content-Range %q", resp.StatusCode, prefix+"0-N")
+	if resp, err = send(prefix); err == nil && resp.StatusCode == http.StatusAccepted {
+		imagePush.rangePrefix = prefix
+	}
+	return resp, err
+}
+
+// deleteUpload 取消仓库上未完成的上传，推送的 context 可能已经取消，使用单独的超时
+func (imagePush *ImagePush) deleteUpload(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(imagePush.username, imagePush.password)
+	if imagePush.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
+	}
+	resp, err := imagePush.httpClient.Do(req)
+	if err != nil {
+		log.Warnf("cancel upload %s failed: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	imagePush.Debugf("DELETE %s: %d", url, resp.StatusCode)
 }
 
 // 这里格外再判断一次401，防止前面的认证失败，代码后续可以优化
@@ -477,7 +837,7 @@ func (imagePush *ImagePush) startPushing(image string) (string, error) {
 	log.Infof("Constructed upload URL: %s", url)
 
 	// 创建 HTTP 请求
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(imagePush.ctx, "POST", url, nil)
 	if err != nil {
 		log.Errorf("Failed to create upload request: %v", err)
 		return "", fmt.Errorf("failed to create upload request: %v", err)
@@ -512,19 +872,18 @@ func (imagePush *ImagePush) startPushing(image string) (string, error) {
 		// 获取新的 Token
 		authHeader := resp.Header.Get("Www-Authenticate")
 		if authHeader != "" {
-			token, err := getToken(authHeader, imagePush.username, imagePush.password)
+			token, err := imagePush.fetchToken(authHeader)
 			if err != nil {
 				log.Errorf("Failed to get new token: %v", err)
 				return "", fmt.Errorf("failed to get new token: %v", err)
 			}
 
-			// 更新 authToken
-			imagePush.authToken = token
-			log.Infof("Successfully obtained new token: %s", token)
+			log.Infof("Successfully obtained new token")
 
 			// 使用新的 Token 重新发送请求
 			req.Header.Set("Authorization", "Bearer "+token)
 			log.Infof("Retrying upload request with new token...")
+			imagePush.emit(Event{Type: EventRetry, Method: req.Method})
 			resp, err = imagePush.httpClient.Do(req)
 			if err != nil {
 				log.Errorf("Failed to retry upload request: %v", err)
@@ -545,7 +904,7 @@ func (imagePush *ImagePush) startPushing(image string) (string, error) {
 		location := resp.Header.Get("Location")
 		if location != "" {
 			log.Infof("Upload initiated successfully, location: %s", location)
-			return location, nil
+			return resolveLocation(url, location), nil
 		} else {
 			log.Errorf("Location header is missing in response")
 			return "", fmt.Errorf("location header is missing in response")
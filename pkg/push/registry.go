@@ -0,0 +1,412 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// OCI 格式的 manifest，没有直接依赖 image-spec
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestAccept 获取 manifest 时接受的格式，不接受 schema1
+var manifestAccept = []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}
+
+// maxConfigSize 镜像配置最大的大小，history 很长时也不会超过
+const maxConfigSize = 4 << 20
+
+// ManifestInfo 仓库里的一个镜像，多架构镜像时 Platforms 包含每个架构
+type ManifestInfo struct {
+	Repository string         `json:"repository"`
+	Reference  string         `json:"reference"`
+	Digest     string         `json:"digest"`
+	MediaType  string         `json:"mediaType"`
+	Size       int64          `json:"size"` // config 和 layer 压缩后的大小之和，多架构镜像为所有架构之和
+	Platforms  []PlatformInfo `json:"platforms"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// PlatformInfo 一个架构的镜像，创建时间、系统和架构来自镜像配置
+type PlatformInfo struct {
+	Digest       string     `json:"digest"`
+	OS           string     `json:"os,omitempty"`
+	Architecture string     `json:"architecture,omitempty"`
+	Variant      string     `json:"variant,omitempty"`
+	Size         int64      `json:"size"`
+	Layers       int        `json:"layers"`
+	Created      *time.Time `json:"created,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+type manifestDoc struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// Catalog 仓库里的镜像列表，last 为上一页的最后一个，返回下一页的 last，没有下一页时为空
+func (imagePush *ImagePush) Catalog(ctx context.Context, n int, last string) ([]string, string, error) {
+	imagePush.ctx = ctx
+	var result struct {
+		Repositories []string `json:"repositories"`
+	}
+	next, err := imagePush.list("/v2/_catalog", n, last, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Repositories, next, nil
+}
+
+// Tags 镜像的 tag 列表，分页同 Catalog
+func (imagePush *ImagePush) Tags(ctx context.Context, repository string, n int, last string) ([]string, string, error) {
+	imagePush.ctx = ctx
+	var result struct {
+		Tags []string `json:"tags"`
+	}
+	next, err := imagePush.list(fmt.Sprintf("/v2/%s/tags/list", repository), n, last, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Tags, next, nil
+}
+
+// list 请求一页列表，下一页的位置从 Link 头里获取
+func (imagePush *ImagePush) list(path string, n int, last string, v interface{}) (string, error) {
+	q := url.Values{}
+	if n > 0 {
+		q.Set("n", fmt.Sprint(n))
+	}
+	if last != "" {
+		q.Set("last", last)
+	}
+	location := imagePush.registryEndpoint + path
+	if len(q) > 0 {
+		location += "?" + q.Encode()
+	}
+	resp, err := imagePush.registryGet(location)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", registryError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("invalid response of %s: %v", path, err)
+	}
+	return nextPage(resp.Header.Get("Link")), nil
+}
+
+// Manifest 获取镜像的 manifest，以及每个架构的大小、创建时间
+func (imagePush *ImagePush) Manifest(ctx context.Context, repository, reference string) (*ManifestInfo, error) {
+	imagePush.ctx = ctx
+	doc, err := imagePush.getManifest(repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	info := &ManifestInfo{Repository: repository, Reference: reference, Digest: doc.digest, MediaType: doc.mediaType}
+	if len(doc.Manifests) == 0 {
+		p := imagePush.platform(repository, doc)
+		info.Platforms = []PlatformInfo{p}
+		info.Size = p.Size
+		return info, nil
+	}
+	info.Platforms = make([]PlatformInfo, 0, len(doc.Manifests))
+	for _, m := range doc.Manifests {
+		// buildx 生成的 attestation 不是镜像
+		if m.Annotations["vnd.docker.reference.type"] != "" {
+			continue
+		}
+		p := PlatformInfo{Digest: m.Digest}
+		if m.Platform != nil {
+			p.OS, p.Architecture, p.Variant = m.Platform.OS, m.Platform.Architecture, m.Platform.Variant
+		}
+		info.Platforms = append(info.Platforms, p)
+	}
+	for i, p := range info.Platforms {
+		child, err := imagePush.getManifest(repository, p.Digest)
+		if err != nil {
+			info.Platforms[i].Error = err.Error()
+			continue
+		}
+		detail := imagePush.platform(repository, child)
+		detail.OS, detail.Architecture, detail.Variant = firstNonEmpty(p.OS, detail.OS), firstNonEmpty(p.Architecture, detail.Architecture), firstNonEmpty(p.Variant, detail.Variant)
+		info.Platforms[i] = detail
+	}
+	for _, p := range info.Platforms {
+		info.Size += p.Size
+	}
+	return info, nil
+}
+
+// platform 单个架构镜像的大小，以及镜像配置里的系统、架构和创建时间
+func (imagePush *ImagePush) platform(repository string, doc *remoteManifest) PlatformInfo {
+	p := PlatformInfo{Digest: doc.digest, Size: doc.Config.Size, Layers: len(doc.Layers)}
+	for _, l := range doc.Layers {
+		p.Size += l.Size
+	}
+	if doc.Config.Digest == "" {
+		return p
+	}
+	resp, err := imagePush.registryGet(fmt.Sprintf("%s/v2/%s/blobs/%s", imagePush.registryEndpoint, repository, doc.Config.Digest))
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.Error = registryError(resp).Error()
+		return p
+	}
+	var config struct {
+		Created      *time.Time `json:"created"`
+		OS           string     `json:"os"`
+		Architecture string     `json:"architecture"`
+		Variant      string     `json:"variant"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxConfigSize)).Decode(&config); err != nil {
+		p.Error = fmt.Sprintf("invalid image config: %v", err)
+		return p
+	}
+	p.Created, p.OS, p.Architecture, p.Variant = config.Created, config.OS, config.Architecture, config.Variant
+	return p
+}
+
+// remoteManifest 仓库里的 manifest，data 为原始内容，重新 PUT 时 digest 不变
+type remoteManifest struct {
+	manifestDoc
+	data      []byte
+	mediaType string
+	digest    string
+}
+
+// blobs manifest 引用的 config 和 layer
+func (m *remoteManifest) blobs() []descriptor {
+	if m.Config.Digest == "" {
+		return m.Layers
+	}
+	return append([]descriptor{m.Config}, m.Layers...)
+}
+
+// getManifest 获取 manifest，仓库没有返回 Docker-Content-Digest 时自己计算 digest
+func (imagePush *ImagePush) getManifest(repository, reference string) (*remoteManifest, error) {
+	resp, err := imagePush.registryGet(fmt.Sprintf("%s/v2/%s/manifests/%s", imagePush.registryEndpoint, repository, reference), manifestAccept...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, registryError(resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return nil, err
+	}
+	m := &remoteManifest{data: body}
+	if err := json.Unmarshal(body, &m.manifestDoc); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	m.mediaType = m.MediaType
+	if m.mediaType == "" {
+		m.mediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+	if !contains(manifestAccept, m.mediaType) {
+		return nil, fmt.Errorf("unsupported manifest type %s", m.mediaType)
+	}
+	m.digest = resp.Header.Get("Docker-Content-Digest")
+	if m.digest == "" {
+		m.digest = "sha256:" + sha256Hex(body)
+	}
+	return m, nil
+}
+
+// registryGet 和推送一样先使用账号密码请求，返回 401 时按 Www-Authenticate 获取 token 后重试，token 保存下来后续使用
+func (imagePush *ImagePush) registryGet(location string, accept ...string) (*http.Response, error) {
+	return imagePush.registryDo(http.MethodGet, location, nil, accept...)
+}
+
+func (imagePush *ImagePush) registryDo(method, location string, body []byte, accept ...string) (*http.Response, error) {
+	return imagePush.registryRequest(method, location, body, func(req *http.Request) {
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+	})
+}
+
+// registryRequest 请求仓库，返回 401 时和推送一样按 Www-Authenticate 获取 token 后重试一次
+func (imagePush *ImagePush) registryRequest(method, location string, body []byte, setHeader func(req *http.Request)) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(imagePush.ctx, method, location, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if imagePush.username != "" {
+			req.SetBasicAuth(imagePush.username, imagePush.password)
+		}
+		if imagePush.authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
+		}
+		setHeader(req)
+		return imagePush.httpClient.Do(req)
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	scheme, params := parseChallenge(resp.Header.Get("Www-Authenticate"))
+	if scheme != "bearer" || params["realm"] == "" {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if _, err := imagePush.authenticate(params, params["scope"]); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// RegistryError 仓库返回的错误，StatusCode 为仓库返回的状态码
+type RegistryError struct {
+	StatusCode int
+	Message    string
+	Err        error // 已知的错误，例如 ErrDeleteDisabled
+}
+
+func (e *RegistryError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("registry returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("registry returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// registryError 把仓库返回的错误转换成 error，仓库返回的错误信息格式为 {"errors":[{"code","message"}]}
+func registryError(resp *http.Response) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		msgs := make([]string, 0, len(body.Errors))
+		for _, e := range body.Errors {
+			msgs = append(msgs, strings.TrimSpace(e.Code+" "+e.Message))
+		}
+		return &RegistryError{StatusCode: resp.StatusCode, Message: strings.Join(msgs, "; ")}
+	}
+	return &RegistryError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+}
+
+// nextPage 从 Link: </v2/_catalog?last=b&n=100>; rel="next" 里取出下一页的 last
+func nextPage(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		target, params, ok := strings.Cut(part, ";")
+		if !ok || !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return ""
+		}
+		return u.Query().Get("last")
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ErrDeleteDisabled 仓库不允许删除 manifest（返回 405）
+var ErrDeleteDisabled = errors.New("the registry does not allow deleting manifests (405): " +
+	"for docker distribution enable it with REGISTRY_STORAGE_DELETE_ENABLED=true, " +
+	"some registries (e.g. cloud registries) only allow deleting images in their own console or API")
+
+// ResolveDigest 把 tag 解析成 manifest 的 digest，reference 本身是 digest 时也会检查是否存在
+func (imagePush *ImagePush) ResolveDigest(ctx context.Context, repository, reference string) (string, error) {
+	imagePush.ctx = ctx
+	resp, err := imagePush.registryDo(http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", imagePush.registryEndpoint, repository, reference), nil, manifestAccept...)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+	} else if resp.StatusCode != http.StatusMethodNotAllowed {
+		// HEAD 没有响应体，错误信息通过 GET 获取
+		if resp.StatusCode == http.StatusNotFound {
+			sep := ":"
+			if strings.Contains(reference, ":") {
+				sep = "@"
+			}
+			return "", &RegistryError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("%s%s%s not found", repository, sep, reference)}
+		}
+		return "", &RegistryError{StatusCode: resp.StatusCode}
+	}
+	// 有的仓库 HEAD 不返回 Docker-Content-Digest，通过 GET 计算
+	m, err := imagePush.getManifest(repository, reference)
+	if err != nil {
+		return "", err
+	}
+	return m.digest, nil
+}
+
+// DeleteManifest 删除 manifest，指向这个 digest 的所有 tag 都会被删除
+func (imagePush *ImagePush) DeleteManifest(ctx context.Context, repository, digest string) error {
+	imagePush.ctx = ctx
+	if !strings.Contains(digest, ":") {
+		return fmt.Errorf("invalid digest %q, resolve the tag first", digest)
+	}
+	resp, err := imagePush.registryDo(http.MethodDelete, fmt.Sprintf("%s/v2/%s/manifests/%s", imagePush.registryEndpoint, repository, digest), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return &RegistryError{StatusCode: resp.StatusCode, Err: ErrDeleteDisabled}
+	}
+	return registryError(resp)
+}
@@ -0,0 +1,101 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"docker-tar-push-ui/pkg/util"
+)
+
+// Tag 把仓库里已有的镜像推送到新的 tag，只获取一次 manifest 再 PUT 到每个目标，不会下载和上传 layer
+// 目标在其他仓库时先把 blob 跨仓库挂载过去，targets 的 Registry 不使用，都在当前仓库内，返回源镜像的 digest
+func (imagePush *ImagePush) Tag(ctx context.Context, source *util.Reference, targets []*util.Reference) (string, error) {
+	imagePush.ctx = ctx
+	m, err := imagePush.getManifest(source.Repository, source.Reference())
+	if err != nil {
+		return "", fmt.Errorf("get %s: %w", source, err)
+	}
+	if source.Digest != "" && source.Digest != m.digest {
+		return "", fmt.Errorf("%s resolves to %s, not %s", source, m.digest, source.Digest)
+	}
+	for _, target := range targets {
+		if target.Tag == "" {
+			return m.digest, fmt.Errorf("tag is required for %s", target)
+		}
+		if target.Repository != source.Repository {
+			if err := imagePush.mountManifest(source.Repository, target.Repository, m); err != nil {
+				return m.digest, fmt.Errorf("copy %s to %s: %w", source, target.Repository, err)
+			}
+		}
+		d, err := imagePush.putManifest(target.Repository, target.Tag, m.data, m.mediaType)
+		if err != nil {
+			return m.digest, fmt.Errorf("tag %s:%s: %w", target.Repository, target.Tag, err)
+		}
+		imagePush.Infof("tagged %s:%s, digest: %s", target.Repository, target.Tag, d)
+	}
+	return m.digest, nil
+}
+
+// mountManifest 把 manifest 引用的 blob 挂载到目标仓库，多架构镜像先处理每个架构的 manifest
+func (imagePush *ImagePush) mountManifest(from, to string, m *remoteManifest) error {
+	for _, child := range m.Manifests {
+		cm, err := imagePush.getManifest(from, child.Digest)
+		if err != nil {
+			return err
+		}
+		if err := imagePush.mountManifest(from, to, cm); err != nil {
+			return err
+		}
+		if _, err := imagePush.putManifest(to, cm.digest, cm.data, cm.mediaType); err != nil {
+			return err
+		}
+	}
+	for _, blob := range m.blobs() {
+		if err := imagePush.mountBlob(from, to, blob.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountBlob 目标仓库没有这个 blob 时从源仓库挂载，仓库不支持挂载时返回错误，不会下载后重新上传
+func (imagePush *ImagePush) mountBlob(from, to, digest string) error {
+	resp, err := imagePush.registryDo(http.MethodHead, fmt.Sprintf("%s/v2/%s/blobs/%s", imagePush.registryEndpoint, to, digest), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		imagePush.Debugf("blob %s already exists in %s", digest, to)
+		return nil
+	case http.StatusNotFound:
+	default:
+		return &RegistryError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("head blob %s in %s", digest, to)}
+	}
+
+	q := url.Values{}
+	q.Set("mount", digest)
+	q.Set("from", from)
+	location := fmt.Sprintf("%s/v2/%s/blobs/uploads/?%s", imagePush.registryEndpoint, to, q.Encode())
+	resp, err = imagePush.registryDo(http.MethodPost, location, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		imagePush.Infof("mount blob %s from %s to %s", digest, from, to)
+		return nil
+	case http.StatusAccepted:
+		// 仓库开始了普通的上传，说明不支持挂载或者没有源仓库的拉取权限
+		if upload := resp.Header.Get("Location"); upload != "" {
+			imagePush.deleteUpload(resolveLocation(location, upload))
+		}
+		return fmt.Errorf("the registry refused to mount blob %s from %s "+
+			"(cross-repository mount unsupported or no pull permission on %s), push the archive to %s instead", digest, from, from, to)
+	}
+	return registryError(resp)
+}
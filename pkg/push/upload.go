@@ -0,0 +1,303 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"docker-tar-push-ui/pkg/util"
+)
+
+// UploadStrategy 上传 blob 的方式，不同的仓库（以及前面的代理）对分片上传的支持不一样
+type UploadStrategy string
+
+const (
+	// UploadAuto 先分片上传，失败后依次换成流式上传和整体上传，成功的方式后面的 blob 继续使用
+	UploadAuto UploadStrategy = "auto"
+	// UploadChunked 多次 PATCH 分片上传，最后一片通过 PUT 带上 digest
+	UploadChunked UploadStrategy = "chunked"
+	// UploadStream 一次 PATCH 上传整个文件，再 PUT 带上 digest
+	UploadStream UploadStrategy = "stream"
+	// UploadMonolithic 一次 PUT 带上 digest 上传整个文件
+	UploadMonolithic UploadStrategy = "monolithic"
+)
+
+// DefaultChunkSize 分片上传默认的分片大小
+const DefaultChunkSize = 2 << 20
+
+// autoStrategies 自动选择时依次尝试的上传方式
+var autoStrategies = []UploadStrategy{UploadChunked, UploadStream, UploadMonolithic}
+
+// ParseUploadStrategy 解析上传方式，空字符串表示 auto
+func ParseUploadStrategy(s string) (UploadStrategy, error) {
+	switch strategy := UploadStrategy(strings.ToLower(strings.TrimSpace(s))); strategy {
+	case "":
+		return UploadAuto, nil
+	case UploadAuto, UploadChunked, UploadStream, UploadMonolithic:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown upload strategy %q, should be one of auto, chunked, stream, monolithic", s)
+}
+
+// SetUploadStrategy 设置上传方式和分片大小，chunkSize 不大于 0 时使用 DefaultChunkSize
+func (imagePush *ImagePush) SetUploadStrategy(strategy UploadStrategy, chunkSize int64) {
+	if strategy == "" {
+		strategy = UploadAuto
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	imagePush.uploadStrategy = strategy
+	imagePush.chunkSize = chunkSize
+}
+
+// fallbackStatus 仓库不支持某种上传方式时返回的状态码，只有这些错误才换下一种方式
+//
+// 400（digest 不对等）和 404（仓库不存在或没有权限）换一种方式也不会成功，直接返回原来的错误
+var fallbackStatus = map[int]bool{
+	http.StatusMethodNotAllowed:             true,
+	http.StatusRequestedRangeNotSatisfiable: true,
+	http.StatusNotImplemented:               true,
+}
+
+// uploadError 上传时仓库返回了非预期的状态码
+func uploadError(resp *http.Response, action string) error {
+	return &RegistryError{StatusCode: resp.StatusCode, Message: action + " failed"}
+}
+
+// shouldFallback 错误是否说明仓库不支持这种上传方式，认证、网络等其他错误换一种方式也不会成功
+func shouldFallback(err error) bool {
+	var regErr *RegistryError
+	return errors.As(err, &regErr) && fallbackStatus[regErr.StatusCode]
+}
+
+// uploadBlob 上传一个 blob，自动选择时仓库不支持一种方式（shouldFallback）时换下一种重新上传，其他错误直接返回
+func (imagePush *ImagePush) uploadBlob(file, image string) error {
+	strategies := []UploadStrategy{imagePush.uploadStrategy}
+	if imagePush.uploadStrategy == UploadAuto {
+		strategies = autoStrategies
+		if imagePush.workingStrategy != "" {
+			strategies = append([]UploadStrategy{imagePush.workingStrategy}, autoStrategies...)
+		}
+	}
+	var err error
+	tried := map[UploadStrategy]bool{}
+	for _, strategy := range strategies {
+		if tried[strategy] {
+			continue
+		}
+		if len(tried) > 0 {
+			imagePush.Infof("upload %s failed: %v, retry with %s upload", path.Base(file), err, strategy)
+		}
+		tried[strategy] = true
+		if err = imagePush.uploadWith(strategy, file, image); err == nil {
+			if imagePush.uploadStrategy == UploadAuto && imagePush.workingStrategy != strategy {
+				imagePush.workingStrategy = strategy
+				imagePush.Debugf("use %s upload for %s", strategy, imagePush.registryEndpoint)
+			}
+			return nil
+		}
+		// 推送被停止或者取消时不再尝试其他方式
+		if cause := imagePush.checkTaskProgress(); cause != nil {
+			return cause
+		}
+		if !shouldFallback(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// uploadWith 使用指定的方式上传，每次都新建一个上传会话
+func (imagePush *ImagePush) uploadWith(strategy UploadStrategy, file, image string) error {
+	location, err := imagePush.startPushing(image)
+	if err != nil {
+		return fmt.Errorf("startPushing Error, %+v", err)
+	}
+	switch strategy {
+	case UploadStream:
+		return imagePush.streamUpload(file, location)
+	case UploadMonolithic:
+		return imagePush.monolithicUpload(file, location)
+	}
+	return imagePush.chunkUpload(file, location)
+}
+
+// streamUpload 一次 PATCH 上传整个文件，再用空的 PUT 带上 digest 完成上传
+func (imagePush *ImagePush) streamUpload(file, location string) (err error) {
+	imagePush.Debugf("stream file %s to %s", file, location)
+	defer func() {
+		if err != nil {
+			imagePush.deleteUpload(location)
+		}
+	}()
+	hash, err := util.Sha256Hash(file)
+	if err != nil {
+		return err
+	}
+	f, size, err := openBlob(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := imagePush.blobRequest(http.MethodPatch, location, imagePush.blobReader(imagePush.progressReader(f, file, size)), size)
+	if err != nil {
+		return err
+	}
+	resp, err := imagePush.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return uploadError(resp, "PATCH blob")
+	}
+	location = nextLocation(resp, location)
+
+	req, err = imagePush.blobRequest(http.MethodPut, withDigest(location, hash), nil, 0)
+	if err != nil {
+		return err
+	}
+	resp, err = imagePush.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return uploadError(resp, "PUT blob")
+	}
+	return nil
+}
+
+// monolithicUpload 一次 PUT 带上 digest 上传整个文件
+func (imagePush *ImagePush) monolithicUpload(file, location string) (err error) {
+	imagePush.Debugf("put file %s to %s", file, location)
+	defer func() {
+		if err != nil {
+			imagePush.deleteUpload(location)
+		}
+	}()
+	hash, err := util.Sha256Hash(file)
+	if err != nil {
+		return err
+	}
+	f, size, err := openBlob(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := imagePush.blobRequest(http.MethodPut, withDigest(location, hash), imagePush.blobReader(imagePush.progressReader(f, file, size)), size)
+	if err != nil {
+		return err
+	}
+	resp, err := imagePush.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return uploadError(resp, "PUT blob")
+	}
+	return nil
+}
+
+func openBlob(file string) (*os.File, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// blobRequest 上传 blob 的请求，body 为 nil 时是空的请求体
+func (imagePush *ImagePush) blobRequest(method, location string, body io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(imagePush.ctx, method, location, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.SetBasicAuth(imagePush.username, imagePush.password)
+	if imagePush.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+imagePush.authToken)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req, nil
+}
+
+// blobReader 上传 blob 的请求体，经过限速
+func (imagePush *ImagePush) blobReader(r io.Reader) io.Reader {
+	if len(imagePush.limiters) == 0 {
+		return r
+	}
+	return util.RateLimitReader(imagePush.ctx, r, imagePush.limiters...)
+}
+
+// progressReader 整个文件一次上传时，每上传一个分片大小打印一次进度
+type progressReader struct {
+	r         io.Reader
+	imagePush *ImagePush
+	file      string
+	size      int64
+	sent      int64
+	next      int64
+	start     time.Time
+}
+
+func (imagePush *ImagePush) progressReader(r io.Reader, file string, size int64) io.Reader {
+	return &progressReader{r: r, imagePush: imagePush, file: file, size: size, next: imagePush.chunkSize, start: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	if n > 0 && (p.sent >= p.next || p.sent == p.size) {
+		p.imagePush.progress(p.file, p.sent, p.size, p.sent, p.start)
+		p.next = p.sent + p.imagePush.chunkSize
+	}
+	return n, err
+}
+
+// nextLocation 后续请求的地址，仓库返回的 Location 可能是相对路径
+func nextLocation(resp *http.Response, current string) string {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return current
+	}
+	return resolveLocation(current, location)
+}
+
+// resolveLocation 把相对路径的 Location 转换成完整的地址
+func resolveLocation(base, location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.IsAbs() {
+		return location
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return location
+	}
+	return b.ResolveReference(u).String()
+}
+
+// withDigest 在上传地址的参数里加上 digest，地址本身可能已经带有参数
+func withDigest(location, hash string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	q := u.Query()
+	q.Set("digest", "sha256:"+hash)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
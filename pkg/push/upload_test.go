@@ -0,0 +1,145 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry 只实现 blob 上传的仓库，PATCH 返回 patchStatus（为 0 时正常接收）
+type testRegistry struct {
+	patchStatus int
+
+	mu       sync.Mutex
+	requests []string
+	uploads  map[string][]byte
+	blobs    map[string][]byte
+	next     int
+}
+
+func newTestRegistry(patchStatus int) (*testRegistry, *httptest.Server) {
+	reg := &testRegistry{patchStatus: patchStatus, uploads: map[string][]byte{}, blobs: map[string][]byte{}}
+	return reg, httptest.NewServer(reg)
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests = append(reg.requests, r.Method)
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+		reg.next++
+		id := fmt.Sprint(reg.next)
+		reg.uploads[id] = nil
+		w.Header().Set("Location", r.URL.Path+id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch:
+		if reg.patchStatus != 0 {
+			w.WriteHeader(reg.patchStatus)
+			return
+		}
+		id := filepath.Base(r.URL.Path)
+		reg.uploads[id] = append(reg.uploads[id], body...)
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		id := filepath.Base(r.URL.Path)
+		data := append(reg.uploads[id], body...)
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		if r.URL.Query().Get("digest") != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(reg.uploads, id)
+		reg.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		delete(reg.uploads, filepath.Base(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (reg *testRegistry) count(method string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	n := 0
+	for _, m := range reg.requests {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+func writeBlob(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "layer.tar")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestUploadBlobFallback(t *testing.T) {
+	const content = "0123456789abcdef"
+	tests := []struct {
+		name         string
+		strategy     UploadStrategy
+		patchStatus  int
+		wantErr      int // 期望的仓库错误状态码，0 表示上传成功
+		wantPosts    int
+		wantStrategy UploadStrategy
+	}{
+		{name: "patch accepted", strategy: UploadAuto, wantPosts: 1, wantStrategy: UploadChunked},
+		{name: "patch not allowed", strategy: UploadAuto, patchStatus: http.StatusMethodNotAllowed, wantPosts: 3, wantStrategy: UploadMonolithic},
+		{name: "patch not implemented", strategy: UploadAuto, patchStatus: http.StatusNotImplemented, wantPosts: 3, wantStrategy: UploadMonolithic},
+		{name: "repository not found", strategy: UploadAuto, patchStatus: http.StatusNotFound, wantErr: http.StatusNotFound, wantPosts: 1},
+		{name: "bad request", strategy: UploadAuto, patchStatus: http.StatusBadRequest, wantErr: http.StatusBadRequest, wantPosts: 1},
+		{name: "server error", strategy: UploadAuto, patchStatus: http.StatusInternalServerError, wantErr: http.StatusInternalServerError, wantPosts: 1},
+		{name: "chunked only", strategy: UploadChunked, patchStatus: http.StatusMethodNotAllowed, wantErr: http.StatusMethodNotAllowed, wantPosts: 1},
+	}
+	for _, tt := range tests {
+		reg, srv := newTestRegistry(tt.patchStatus)
+		imagePush := NewImagePush("", srv.URL, "", "", "", false, io.Discard)
+		// 分片比文件小，分片上传和流式上传都会用到 PATCH
+		imagePush.SetUploadStrategy(tt.strategy, 4)
+		err := imagePush.uploadBlob(writeBlob(t, content), "library/app")
+		srv.Close()
+
+		if tt.wantErr == 0 {
+			if err != nil {
+				t.Errorf("%s: uploadBlob() error: %v", tt.name, err)
+				continue
+			}
+			sum := sha256.Sum256([]byte(content))
+			if got := string(reg.blobs["sha256:"+hex.EncodeToString(sum[:])]); got != content {
+				t.Errorf("%s: uploaded blob = %q, want %q", tt.name, got, content)
+			}
+			if imagePush.workingStrategy != tt.wantStrategy {
+				t.Errorf("%s: working strategy = %s, want %s", tt.name, imagePush.workingStrategy, tt.wantStrategy)
+			}
+		} else {
+			var regErr *RegistryError
+			if !errors.As(err, &regErr) || regErr.StatusCode != tt.wantErr {
+				t.Errorf("%s: uploadBlob() error = %v, want registry error %d", tt.name, err, tt.wantErr)
+			}
+		}
+		// 每种方式新建一个上传会话，不支持的错误才会换下一种方式
+		if posts := reg.count(http.MethodPost); posts != tt.wantPosts {
+			t.Errorf("%s: %d upload sessions, want %d", tt.name, posts, tt.wantPosts)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package util
+
+import "errors"
+
+// DiskFree 不支持的平台返回错误，就绪检查会跳过磁盘空间检查
+func DiskFree(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package util
+
+import "syscall"
+
+// DiskFree 目录所在磁盘的可用空间（字节）
+func DiskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限速，单位是字节每秒，limit 为 0 表示不限速
+//
+// 多个请求共享同一个限速器时按到达顺序排队领取令牌，平分带宽；nil 也表示不限速
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter 创建限速器
+func NewRateLimiter(limit int64) *RateLimiter {
+	return &RateLimiter{limit: limit, last: time.Now()}
+}
+
+// SetLimit 调整限速，正在等待的请求按新的速度继续
+func (l *RateLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.limit = limit
+	if limit > 0 && l.tokens > float64(limit) {
+		l.tokens = float64(limit)
+	}
+}
+
+// Limit 当前的限速，0 表示不限速
+func (l *RateLimiter) Limit() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// refill 按经过的时间补充令牌，最多攒一秒的令牌，调用方需要持有锁
+func (l *RateLimiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+	l.last = now
+}
+
+// WaitN 领取 n 个字节的令牌，令牌不够时等待，ctx 取消时返回
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.limit <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.refill(now)
+	// 先预支令牌，后来的请求排在后面
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// 每次读取的最大字节数，避免一次领取太多令牌导致速度不平稳
+const rateLimitChunk = 32 << 10
+
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// RateLimitReader 读取时同时受所有限速器的限制，实际速度取决于最慢的那个
+func RateLimitReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if werr := l.WaitN(r.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
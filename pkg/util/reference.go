@@ -0,0 +1,108 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// Reference 镜像地址，例如 harbor.example.com:8443/library/nginx:1.25@sha256:...
+type Reference struct {
+	Registry   string // 仓库地址 host[:port]，没有写时为空，不会补充 docker.io
+	Repository string // 仓库里的路径，例如 library/nginx
+	Tag        string
+	Digest     string
+}
+
+// ParseReference 解析镜像地址，第一段包含 . 或者 : 或者是 localhost 时作为仓库地址，tag 和 digest 都可以省略
+func ParseReference(s string) (*Reference, error) {
+	s = strings.TrimSpace(s)
+	ref, err := reference.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", s, err)
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return nil, fmt.Errorf("invalid image reference %q: repository name is required", s)
+	}
+	r := &Reference{Repository: named.Name()}
+	// reference.Parse 把第一段都当成仓库地址，按 docker 的规则区分 host 和路径
+	if i := strings.IndexRune(r.Repository, '/'); i > 0 {
+		if host := r.Repository[:i]; strings.ContainsAny(host, ".:") || host == "localhost" || strings.ToLower(host) != host {
+			r.Registry, r.Repository = host, r.Repository[i+1:]
+		}
+	}
+	if strings.ToLower(r.Repository) != r.Repository {
+		return nil, fmt.Errorf("invalid image reference %q: repository name must be lowercase", s)
+	}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		r.Tag = tagged.Tag()
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		r.Digest = digested.Digest().String()
+	}
+	return r, nil
+}
+
+var anchoredTag = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+// ParseTags 解析逗号分隔的 tag 列表，例如 latest,stable，去掉空白和重复的 tag
+func ParseTags(s string) ([]string, error) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !anchoredTag.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// ParseTagTarget 解析加 tag 的目标，只写 tag 时在 source 的镜像里，写了镜像名时可以是同一个仓库地址里的其他镜像
+func ParseTagTarget(source *Reference, s string) (*Reference, error) {
+	s = strings.TrimSpace(s)
+	if !strings.ContainsAny(s, ":/@") {
+		if !anchoredTag.MatchString(s) {
+			return nil, fmt.Errorf("invalid tag %q", s)
+		}
+		return &Reference{Registry: source.Registry, Repository: source.Repository, Tag: s}, nil
+	}
+	target, err := ParseReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if target.Digest != "" || target.Tag == "" {
+		return nil, fmt.Errorf("%s: a tag is required and digest is not allowed, e.g. %s:1.0", s, target.Repository)
+	}
+	return target, nil
+}
+
+// Reference 镜像在仓库里的引用，有 digest 时使用 digest，否则使用 tag
+func (r *Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r *Reference) String() string {
+	s := r.Repository
+	if r.Registry != "" {
+		s = r.Registry + "/" + s
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testDigest = "sha256:941e25b4f192fd4baeb8a520527360b8a69c30a5dd60cf176a22da05e85cf003"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *Reference
+		wantErr bool
+	}{
+		{in: "nginx", want: &Reference{Repository: "nginx"}},
+		{in: " nginx:1.25 ", want: &Reference{Repository: "nginx", Tag: "1.25"}},
+		{in: "library/nginx:latest", want: &Reference{Repository: "library/nginx", Tag: "latest"}},
+		{in: "team-a/sub/app:v1", want: &Reference{Repository: "team-a/sub/app", Tag: "v1"}},
+		{in: "harbor.example.com/library/nginx:1.25", want: &Reference{Registry: "harbor.example.com", Repository: "library/nginx", Tag: "1.25"}},
+		{in: "harbor.example.com:8443/team/app", want: &Reference{Registry: "harbor.example.com:8443", Repository: "team/app"}},
+		{in: "localhost/app:1", want: &Reference{Registry: "localhost", Repository: "app", Tag: "1"}},
+		{in: "localhost:5000/team/app:2.0", want: &Reference{Registry: "localhost:5000", Repository: "team/app", Tag: "2.0"}},
+		{in: "app@" + testDigest, want: &Reference{Repository: "app", Digest: testDigest}},
+		{in: "reg.io/app:1@" + testDigest, want: &Reference{Registry: "reg.io", Repository: "app", Tag: "1", Digest: testDigest}},
+		{in: "", wantErr: true},
+		{in: "App:1", wantErr: true},
+		{in: "reg.io/Team/app", wantErr: true},
+		{in: "app:", wantErr: true},
+		{in: "app:bad tag", wantErr: true},
+		{in: "app@sha256:123", wantErr: true},
+		{in: "-app", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseReference(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseReference(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseReference(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTagTarget(t *testing.T) {
+	source := &Reference{Registry: "harbor.example.com", Repository: "library/nginx", Tag: "1.25"}
+	tests := []struct {
+		in      string
+		want    *Reference
+		wantErr bool
+	}{
+		{in: "stable", want: &Reference{Registry: "harbor.example.com", Repository: "library/nginx", Tag: "stable"}},
+		{in: " 1.25.3 ", want: &Reference{Registry: "harbor.example.com", Repository: "library/nginx", Tag: "1.25.3"}},
+		{in: "mirror/nginx:1.25", want: &Reference{Repository: "mirror/nginx", Tag: "1.25"}},
+		{in: "other.io/mirror/nginx:1.25", want: &Reference{Registry: "other.io", Repository: "mirror/nginx", Tag: "1.25"}},
+		{in: "nginx:latest", want: &Reference{Repository: "nginx", Tag: "latest"}},
+		{in: "-bad", wantErr: true},
+		{in: "mirror/nginx", wantErr: true},
+		{in: "nginx@" + testDigest, wantErr: true},
+		{in: "nginx:1@" + testDigest, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTagTarget(source, tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseTagTarget(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTagTarget(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTagTarget(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "latest", want: []string{"latest"}},
+		{in: " latest, stable ,latest,,1.0", want: []string{"latest", "stable", "1.0"}},
+		{in: "latest,bad tag", wantErr: true},
+		{in: "a/b", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTags(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTags(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/silenceper/log"
+)
+
+// ErrUnsafePath 路径超出了允许的目录，或者文件名不合法
+var ErrUnsafePath = errors.New("unsafe path")
+
+// unsafePath 记录并返回路径越界错误，所有的越界访问都会打印告警日志
+func unsafePath(root, name, reason string) error {
+	log.Warnf("rejected unsafe path %q (root %q): %s", name, root, reason)
+	return fmt.Errorf("%w: %s (%s)", ErrUnsafePath, name, reason)
+}
+
+// SanitizeFileName 校验客户端传入的文件名，只允许单纯的文件名
+//
+// 不允许包含目录分隔符、..、控制字符，也不允许以 . 开头（和 .meta/.partial 等内部目录冲突）
+func SanitizeFileName(name string) (string, error) {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", unsafePath("", name, "empty file name")
+	case strings.ContainsAny(name, `/\`):
+		return "", unsafePath("", name, "file name contains path separator")
+	case strings.HasPrefix(name, "."):
+		return "", unsafePath("", name, "hidden file name")
+	case len(name) > 255:
+		return "", unsafePath("", name, "file name too long")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", unsafePath("", name, "file name contains control character")
+		}
+	}
+	return name, nil
+}
+
+// SafeJoin 把相对路径拼接到 root 下，拒绝绝对路径、跳出 root 的 .. 以及通过符号链接指向 root 以外的路径
+func SafeJoin(root, name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", unsafePath(root, name, "invalid path")
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+		return "", unsafePath(root, name, "absolute path")
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", unsafePath(root, name, "path escapes root")
+	}
+	target := filepath.Join(root, cleaned)
+	if err := checkSymlinks(root, target); err != nil {
+		return "", unsafePath(root, name, err.Error())
+	}
+	return target, nil
+}
+
+// Within 判断 target 是否在 root 目录内（只做字面上的判断）
+func Within(root, target string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(target))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// checkSymlinks 解析 target 已经存在的部分，确保没有通过符号链接跳出 root
+func checkSymlinks(root, target string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		// root 还不存在，也就不会有符号链接
+		return nil
+	}
+	existing := target
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		existing = parent
+	}
+	realTarget, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// 指向不存在文件的符号链接，按照链接本身判断
+		return fmt.Errorf("broken symlink %s", existing)
+	}
+	if !Within(realRoot, realTarget) {
+		return fmt.Errorf("symlink %s points outside of root", existing)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"images.tar", false},
+		{"nginx 1.25.tar.gz", false},
+		{"镜像.tar", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../images.tar", true},
+		{"a/b.tar", true},
+		{`a\b.tar`, true},
+		{"/etc/passwd", true},
+		{".meta", true},
+		{"images\x00.tar", true},
+		{"images\n.tar", true},
+		{strings.Repeat("a", 256), true},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeFileName(tt.name)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("SanitizeFileName(%q) = %q, %v, want ErrUnsafePath", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.name {
+			t.Errorf("SanitizeFileName(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 指向 root 以外和 root 以内的符号链接
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "broken")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "manifest.json", want: filepath.Join(root, "manifest.json")},
+		{name: "sub/layer.tar", want: filepath.Join(root, "sub", "layer.tar")},
+		{name: "./sub/../layer.tar", want: filepath.Join(root, "layer.tar")},
+		{name: "new/dir/file", want: filepath.Join(root, "new", "dir", "file")},
+		{name: "inside/layer.tar", want: filepath.Join(root, "inside", "layer.tar")},
+		{name: "", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "../etc/passwd", wantErr: true},
+		{name: "sub/../../etc/passwd", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: `\etc\passwd`, wantErr: true},
+		{name: "a\x00b", wantErr: true},
+		{name: "escape/file", wantErr: true},
+		{name: "escape/new/file", wantErr: true},
+		{name: "broken/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := SafeJoin(root, tt.name)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("SafeJoin(%q) = %q, %v, want ErrUnsafePath", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("SafeJoin(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		root   string
+		target string
+		want   bool
+	}{
+		{"/tmp/root", "/tmp/root", true},
+		{"/tmp/root", "/tmp/root/a/b", true},
+		{"/tmp/root/", "/tmp/root/a/../b", true},
+		{"/tmp/root", "/tmp/root/../other", false},
+		{"/tmp/root", "/tmp/rootx/a", false},
+		{"/tmp/root", "/etc/passwd", false},
+		{"/tmp/root", "..foo", false},
+	}
+	for _, tt := range tests {
+		if got := Within(tt.root, tt.target); got != tt.want {
+			t.Errorf("Within(%q, %q) = %v, want %v", tt.root, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDecompressReaderUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		entries     []testEntry
+		outsideLink bool // 临时目录里已经有一个指向外部的符号链接 escape
+		wantErr     bool
+	}{
+		{name: "docker save layer symlink", entries: []testEntry{
+			{name: "a/layer.tar", body: "layer"},
+			{name: "b/layer.tar", linkname: "../a/layer.tar"},
+		}},
+		{name: "parent directory", entries: []testEntry{{name: "../evil", body: "x"}}, wantErr: true},
+		{name: "nested parent directory", entries: []testEntry{{name: "a/../../evil", body: "x"}}, wantErr: true},
+		{name: "absolute path", entries: []testEntry{{name: "/tmp/evil", body: "x"}}, wantErr: true},
+		{name: "absolute symlink", entries: []testEntry{{name: "link", linkname: "/etc"}}, wantErr: true},
+		{name: "relative symlink outside", entries: []testEntry{{name: "a/link", linkname: "../../etc"}}, wantErr: true},
+		{name: "write through symlinked parent", entries: []testEntry{{name: "escape/evil", body: "x"}}, outsideLink: true, wantErr: true},
+		{name: "hard link outside", entries: []testEntry{{name: "link", linkname: "../evil", hardlink: true}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "root")
+		if tt.outsideLink {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(parent, filepath.Join(dir, "escape")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := DecompressReader(bytes.NewReader(makeTar(t, tt.entries...)), "images.tar", dir)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("%s: DecompressReader() error = %v, want ErrUnsafePath", tt.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: DecompressReader() error: %v", tt.name, err)
+		}
+		// 不管是否报错，都不能在临时目录以外创建文件
+		if _, err := os.Lstat(filepath.Join(parent, "evil")); err == nil {
+			t.Errorf("%s: file written outside of root", tt.name)
+		}
+	}
+}
+
+func TestDecompressZipUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		body     string
+		symlink  bool
+		wantErr  bool
+		wantFile string
+	}{
+		{name: "regular file", file: "sub/manifest.json", body: "[]", wantFile: "sub/manifest.json"},
+		{name: "inner symlink", file: "link", body: "sub", symlink: true, wantFile: "link"},
+		{name: "parent directory", file: "../evil", body: "x", wantErr: true},
+		{name: "absolute path", file: "/evil", body: "x", wantErr: true},
+		{name: "symlink outside", file: "link", body: "../../evil", symlink: true, wantErr: true},
+		{name: "absolute symlink", file: "link", body: "/etc/passwd", symlink: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		header := &zip.FileHeader{Name: tt.file, Method: zip.Store}
+		if tt.symlink {
+			header.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(tt.body))
+		zw.Close()
+
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "root")
+		err = DecompressReader(&buf, "images.zip", dir)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("%s: DecompressReader() error = %v, want ErrUnsafePath", tt.name, err)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "evil")); err == nil {
+				t.Errorf("%s: file written outside of root", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: DecompressReader() error: %v", tt.name, err)
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, tt.wantFile)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChecksumSuffix sha256 校验文件的后缀，内容与 sha256sum 的输出格式一致
+const ChecksumSuffix = ".sha256"
+
+var (
+	// images.tar.part-aa images.tar.part-ab ...
+	letterPartRe = regexp.MustCompile(`^(.+)\.part-([a-z]{2,})$`)
+	// images.tar.001 images.tar.002 ...，只识别镜像包格式的文件，避免把 app.log.001 之类的文件当成分卷
+	numericPartRe = regexp.MustCompile(`(?i)^(.+\.(?:tar|tar\.gz|tgz|tar\.bz2|tbz2?|tar\.xz|txz|tar\.zst|tar\.lz4|tlz4|tar\.sz|tsz|tar\.br|tbr|zip|rar))\.(\d{3,})$`)
+)
+
+// Archive 逻辑上的一个镜像包，普通文件只有一个分片，分卷包会包含多个分片
+type Archive struct {
+	Name  string   // 逻辑文件名，例如 images.tar
+	Path  string   // 逻辑路径，例如 uploads/images.tar，分卷包时该文件并不存在
+	Parts []string // 按顺序排列的分片路径
+	Split bool     // 是否是分卷包
+
+	seqs []int // 每个分片的序号，和Parts一一对应
+}
+
+// ParseSplitPart 判断文件名是否是分卷，返回逻辑文件名和分片序号
+func ParseSplitPart(name string) (base string, seq int, width int, ok bool) {
+	if m := letterPartRe.FindStringSubmatch(name); m != nil {
+		seq := 0
+		for _, c := range m[2] {
+			seq = seq*26 + int(c-'a')
+		}
+		return m[1], seq, len(m[2]), true
+	}
+	if m := numericPartRe.FindStringSubmatch(name); m != nil {
+		seq, err := strconv.Atoi(m[2])
+		if err != nil {
+			return "", 0, 0, false
+		}
+		return m[1], seq, len(m[2]), true
+	}
+	return "", 0, 0, false
+}
+
+// IsChecksumFile 是否是 .sha256 校验文件
+func IsChecksumFile(name string) bool {
+	return strings.HasSuffix(name, ChecksumSuffix)
+}
+
+// ScanArchives 把文件列表按分卷归并成逻辑上的镜像包，.sha256 校验文件不会作为镜像包返回
+func ScanArchives(paths []string) []*Archive {
+	var archives []*Archive
+	sets := map[string]*Archive{}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if IsChecksumFile(name) {
+			continue
+		}
+		base, seq, _, ok := ParseSplitPart(name)
+		if !ok {
+			archives = append(archives, &Archive{Name: name, Path: p, Parts: []string{p}})
+			continue
+		}
+		logical := filepath.Join(filepath.Dir(p), base)
+		set, exists := sets[logical]
+		if !exists {
+			set = &Archive{Name: base, Path: logical, Split: true}
+			sets[logical] = set
+			archives = append(archives, set)
+		}
+		set.Parts = append(set.Parts, p)
+		set.seqs = append(set.seqs, seq)
+	}
+	for _, set := range sets {
+		sort.Sort(byPartSeq{set})
+	}
+	return archives
+}
+
+type byPartSeq struct{ *Archive }
+
+func (a byPartSeq) Len() int           { return len(a.Parts) }
+func (a byPartSeq) Less(i, j int) bool { return a.seqs[i] < a.seqs[j] }
+func (a byPartSeq) Swap(i, j int) {
+	a.Parts[i], a.Parts[j] = a.Parts[j], a.Parts[i]
+	a.seqs[i], a.seqs[j] = a.seqs[j], a.seqs[i]
+}
+
+// FindArchives 根据路径查找镜像包
+//
+// 路径可以是目录、普通文件、某一个分片，或者只存在分片的逻辑文件名（例如 uploads/images.tar）
+func FindArchives(path string) ([]*Archive, error) {
+	if Exists(path) {
+		files, err := FilesPath(path)
+		if err != nil {
+			return nil, err
+		}
+		// 指定的是某一个分片，把同一组的分片都找出来
+		if len(files) == 1 {
+			if base, _, _, ok := ParseSplitPart(filepath.Base(path)); ok {
+				return findSplitSet(filepath.Join(filepath.Dir(path), base))
+			}
+		}
+		return ScanArchives(files), nil
+	}
+	return findSplitSet(path)
+}
+
+func findSplitSet(logical string) ([]*Archive, error) {
+	entries, err := os.ReadDir(filepath.Dir(logical))
+	if err != nil {
+		return nil, fmt.Errorf("%s not exists", logical)
+	}
+	var parts []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if base, _, _, ok := ParseSplitPart(entry.Name()); ok && base == filepath.Base(logical) {
+			parts = append(parts, filepath.Join(filepath.Dir(logical), entry.Name()))
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%s not exists", logical)
+	}
+	return ScanArchives(parts), nil
+}
+
+// ChecksumPath 镜像包对应的 .sha256 校验文件路径
+func (a *Archive) ChecksumPath() string {
+	return a.Path + ChecksumSuffix
+}
+
+// Check 检查分片是否齐全：序号必须连续，且校验文件里列出的分片都要存在
+func (a *Archive) Check() error {
+	if !a.Split {
+		return nil
+	}
+	_, first, width, _ := ParseSplitPart(filepath.Base(a.Parts[0]))
+	// 字母后缀从 aa 开始，数字后缀允许从 000 或 001 开始
+	if first > 1 || (first == 1 && letterPartRe.MatchString(filepath.Base(a.Parts[0]))) {
+		return fmt.Errorf("%s: missing part before %s", a.Name, filepath.Base(a.Parts[0]))
+	}
+	for i, part := range a.Parts {
+		_, seq, w, _ := ParseSplitPart(filepath.Base(part))
+		if w != width {
+			return fmt.Errorf("%s: part %s has inconsistent suffix width", a.Name, filepath.Base(part))
+		}
+		if seq != first+i {
+			return fmt.Errorf("%s: missing part before %s", a.Name, filepath.Base(part))
+		}
+	}
+	sums, err := a.checksums()
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, part := range a.Parts {
+		present[filepath.Base(part)] = true
+	}
+	for name := range sums {
+		if name == a.Name {
+			continue
+		}
+		if !present[name] {
+			return fmt.Errorf("%s: missing part %s listed in %s", a.Name, name, filepath.Base(a.ChecksumPath()))
+		}
+	}
+	return nil
+}
+
+// checksums 读取校验文件，返回 文件名 => sha256，没有校验文件时返回空
+func (a *Archive) checksums() (map[string]string, error) {
+	if !Exists(a.ChecksumPath()) {
+		return map[string]string{}, nil
+	}
+	return ReadChecksumFile(a.ChecksumPath())
+}
+
+// ReadChecksumFile 解析 sha256sum 格式的校验文件：每行 "<hash>  <文件名>"
+func ReadChecksumFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sum := strings.ToLower(strings.TrimPrefix(fields[0], "sha256:"))
+		if len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid checksum line in %s: %s", file, scanner.Text())
+		}
+		name := ""
+		if len(fields) > 1 {
+			// 二进制模式下文件名前面会带 *
+			name = filepath.Base(strings.TrimPrefix(fields[1], "*"))
+		}
+		sums[name] = sum
+	}
+	return sums, scanner.Err()
+}
+
+// Open 按顺序把所有分片读成一个连续的数据流
+//
+// 如果存在校验文件，会在读到每个分片和整个数据流末尾时校验 sha256，不一致时返回错误
+func (a *Archive) Open() (io.ReadCloser, error) {
+	if err := a.Check(); err != nil {
+		return nil, err
+	}
+	sums, err := a.checksums()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		readers []io.Reader
+		files   []*os.File
+	)
+	closeAll := func() error {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil
+	}
+	for _, part := range a.Parts {
+		f, err := os.Open(part)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		name := filepath.Base(part)
+		if sum, ok := sums[name]; ok && name != a.Name {
+			readers = append(readers, newVerifyReader(f, name, sum))
+		} else {
+			readers = append(readers, f)
+		}
+	}
+	var r io.Reader = io.MultiReader(readers...)
+	if sum, ok := sums[a.Name]; ok {
+		r = newVerifyReader(r, a.Name, sum)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, closerFunc(closeAll)}, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// verifyReader 读到末尾时校验 sha256
+type verifyReader struct {
+	r    io.Reader
+	h    hash.Hash
+	name string
+	sum  string
+}
+
+func newVerifyReader(r io.Reader, name, sum string) *verifyReader {
+	return &verifyReader{r: r, h: sha256.New(), name: name, sum: sum}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); got != v.sum {
+			return n, fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", v.name, v.sum, got)
+		}
+	}
+	return n, err
+}
+
+// SplitFile 把文件按 size 大小切分成分卷，并生成 .sha256 校验文件
+//
+// numeric 为 true 时后缀为 .001 .002 ...，否则为 .part-aa .part-ab ...
+func SplitFile(src, outDir string, size int64, numeric bool) ([]string, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", size)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(src)
+	if numeric && !numericPartRe.MatchString(name+".001") {
+		return nil, fmt.Errorf("numeric suffixes are only recognized for tar, zip and rar archives, split %s without --numeric", name)
+	}
+	if outDir == "" {
+		outDir = filepath.Dir(src)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	count := int((stat.Size() + size - 1) / size)
+	if count == 0 {
+		count = 1
+	}
+	total := sha256.New()
+	var (
+		parts []string
+		lines []string
+	)
+	for i := 0; i < count; i++ {
+		partName := name + splitSuffix(i, count, numeric)
+		partPath := filepath.Join(outDir, partName)
+		out, err := os.Create(partPath)
+		if err != nil {
+			return parts, err
+		}
+		h := sha256.New()
+		_, err = io.CopyN(io.MultiWriter(out, h, total), f, size)
+		out.Close()
+		if err != nil && err != io.EOF {
+			return parts, fmt.Errorf("write %s failed: %w", partPath, err)
+		}
+		parts = append(parts, partPath)
+		lines = append(lines, fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), partName))
+	}
+	lines = append(lines, fmt.Sprintf("%s  %s\n", hex.EncodeToString(total.Sum(nil)), name))
+	checksumPath := filepath.Join(outDir, name+ChecksumSuffix)
+	if err := os.WriteFile(checksumPath, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return parts, err
+	}
+	return parts, nil
+}
+
+func splitSuffix(i, count int, numeric bool) string {
+	if numeric {
+		width := len(strconv.Itoa(count))
+		if width < 3 {
+			width = 3
+		}
+		return fmt.Sprintf(".%0*d", width, i+1)
+	}
+	width := 2
+	for n := 26 * 26; n < count; n *= 26 {
+		width++
+	}
+	suffix := make([]byte, width)
+	for j := width - 1; j >= 0; j-- {
+		suffix[j] = byte('a' + i%26)
+		i /= 26
+	}
+	return ".part-" + string(suffix)
+}
@@ -0,0 +1,236 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSplitPart(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		seq   int
+		width int
+		ok    bool
+	}{
+		{"images.tar.part-aa", "images.tar", 0, 2, true},
+		{"images.tar.part-ab", "images.tar", 1, 2, true},
+		{"images.tar.part-ba", "images.tar", 26, 2, true},
+		{"images.tar.part-aaa", "images.tar", 0, 3, true},
+		{"images.tar.001", "images.tar", 1, 3, true},
+		{"images.tar.gz.012", "images.tar.gz", 12, 3, true},
+		{"images.TGZ.000", "images.TGZ", 0, 3, true},
+		{"images.tar.zst.0001", "images.tar.zst", 1, 4, true},
+		{"images.zip.002", "images.zip", 2, 3, true},
+		{"images.tar", "", 0, 0, false},
+		{"images.tar.01", "", 0, 0, false},
+		{"app.log.001", "", 0, 0, false},
+		{"images.tar.part-a", "", 0, 0, false},
+		{"images.tar.part-AB", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		base, seq, width, ok := ParseSplitPart(tt.name)
+		if base != tt.base || seq != tt.seq || width != tt.width || ok != tt.ok {
+			t.Errorf("ParseSplitPart(%q) = %q, %d, %d, %v, want %q, %d, %d, %v", tt.name, base, seq, width, ok, tt.base, tt.seq, tt.width, tt.ok)
+		}
+	}
+}
+
+func TestScanArchives(t *testing.T) {
+	archives := ScanArchives([]string{
+		"up/images.tar.003",
+		"up/nginx.tar",
+		"up/images.tar.001",
+		"up/images.tar.sha256",
+		"up/images.tar.002",
+		"up/app.log.001",
+	})
+	if len(archives) != 3 {
+		t.Fatalf("ScanArchives() returned %d archives, want 3", len(archives))
+	}
+	split := archives[0]
+	if split.Name != "images.tar" || split.Path != filepath.Join("up", "images.tar") || !split.Split {
+		t.Errorf("split archive = %+v", split)
+	}
+	// 分片按序号排序，和传入的顺序无关
+	if want := []string{"up/images.tar.001", "up/images.tar.002", "up/images.tar.003"}; !reflect.DeepEqual(split.Parts, want) {
+		t.Errorf("parts = %q, want %q", split.Parts, want)
+	}
+	if archives[1].Name != "nginx.tar" || archives[1].Split || archives[2].Name != "app.log.001" || archives[2].Split {
+		t.Errorf("plain archives = %+v, %+v", archives[1], archives[2])
+	}
+}
+
+// splitTestFile 生成一个测试文件并切分，返回原始内容、目录和逻辑路径
+func splitTestFile(t *testing.T, name string, numeric bool) ([]byte, string, string) {
+	t.Helper()
+	src := t.TempDir()
+	data := bytes.Repeat([]byte("docker-tar-push "), 640) // 10240 字节
+	if err := os.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	parts, err := SplitFile(filepath.Join(src, name), dir, 3000, numeric)
+	if err != nil {
+		t.Fatalf("SplitFile() error: %v", err)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("SplitFile() created %d parts, want 4", len(parts))
+	}
+	return data, dir, filepath.Join(dir, name)
+}
+
+func findTestArchive(t *testing.T, logical string) *Archive {
+	t.Helper()
+	archives, err := FindArchives(logical)
+	if err != nil {
+		t.Fatalf("FindArchives() error: %v", err)
+	}
+	if len(archives) != 1 {
+		t.Fatalf("FindArchives() returned %d archives, want 1", len(archives))
+	}
+	return archives[0]
+}
+
+func readArchive(a *Archive) ([]byte, error) {
+	r, err := a.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestSplitFileRoundTrip(t *testing.T) {
+	for _, numeric := range []bool{false, true} {
+		data, dir, logical := splitTestFile(t, "images.tar", numeric)
+		suffix := ".part-aa"
+		if numeric {
+			suffix = ".001"
+		}
+		if !Exists(filepath.Join(dir, "images.tar"+suffix)) || !Exists(logical+ChecksumSuffix) {
+			t.Errorf("numeric=%v: first part or checksum file missing", numeric)
+		}
+		archive := findTestArchive(t, logical)
+		if err := archive.Check(); err != nil {
+			t.Errorf("numeric=%v: Check() error: %v", numeric, err)
+		}
+		got, err := readArchive(archive)
+		if err != nil {
+			t.Errorf("numeric=%v: read error: %v", numeric, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("numeric=%v: reassembled %d bytes, want %d", numeric, len(got), len(data))
+		}
+		// 指定其中一个分片也能找到整组
+		if a := findTestArchive(t, filepath.Join(dir, "images.tar"+suffix)); len(a.Parts) != 4 {
+			t.Errorf("numeric=%v: found %d parts from a single part, want 4", numeric, len(a.Parts))
+		}
+	}
+}
+
+func TestSplitFileNumericRequiresArchive(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(src, []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SplitFile(src, "", 1, true); err == nil {
+		t.Error("SplitFile() with numeric suffix for app.log should fail")
+	}
+	if _, err := SplitFile(src, "", 0, false); err == nil {
+		t.Error("SplitFile() with size 0 should fail")
+	}
+}
+
+func TestArchiveCheckMissingPart(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove string
+		want   string
+	}{
+		{"first part", "images.tar.001", "missing part before images.tar.002"},
+		{"middle part", "images.tar.002", "missing part before images.tar.003"},
+		// 序号是连续的，只能通过校验文件发现缺少最后一片
+		{"last part", "images.tar.004", "missing part images.tar.004"},
+	}
+	for _, tt := range tests {
+		_, dir, logical := splitTestFile(t, "images.tar", true)
+		if err := os.Remove(filepath.Join(dir, tt.remove)); err != nil {
+			t.Fatal(err)
+		}
+		archive := findTestArchive(t, logical)
+		err := archive.Check()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Check() error = %v, want %q", tt.name, err, tt.want)
+		}
+		if _, err := archive.Open(); err == nil {
+			t.Errorf("%s: Open() should fail", tt.name)
+		}
+	}
+}
+
+func TestArchiveCheckInconsistentWidth(t *testing.T) {
+	archives := ScanArchives([]string{"up/images.tar.001", "up/images.tar.0002"})
+	if err := archives[0].Check(); err == nil || !strings.Contains(err.Error(), "inconsistent suffix width") {
+		t.Errorf("Check() error = %v, want inconsistent suffix width", err)
+	}
+}
+
+func TestArchiveOpenCorruptedPart(t *testing.T) {
+	_, dir, logical := splitTestFile(t, "images.tar", false)
+	part := filepath.Join(dir, "images.tar.part-ab")
+	data, err := os.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 大小不变，只改一个字节
+	data[100] ^= 0xff
+	if err := os.WriteFile(part, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := findTestArchive(t, logical)
+	if err := archive.Check(); err != nil {
+		t.Fatalf("Check() error: %v", err)
+	}
+	_, err = readArchive(archive)
+	if err == nil || !strings.Contains(err.Error(), "sha256 mismatch for images.tar.part-ab") {
+		t.Errorf("read error = %v, want sha256 mismatch for images.tar.part-ab", err)
+	}
+
+	// 没有校验文件时无法发现损坏
+	if err := os.Remove(logical + ChecksumSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArchive(findTestArchive(t, logical)); err != nil {
+		t.Errorf("read without checksum file error: %v", err)
+	}
+}
+
+func TestReadChecksumFile(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	file := filepath.Join(t.TempDir(), "images.tar.sha256")
+	content := sum + "  images.tar.part-aa\n" +
+		"sha256:" + strings.ToUpper(sum) + " *dir/images.tar\n" +
+		"\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadChecksumFile(file)
+	if err != nil {
+		t.Fatalf("ReadChecksumFile() error: %v", err)
+	}
+	if want := map[string]string{"images.tar.part-aa": sum, "images.tar": sum}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadChecksumFile() = %v, want %v", got, want)
+	}
+
+	if err := os.WriteFile(file, []byte("1234  images.tar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadChecksumFile(file); err == nil {
+		t.Error("ReadChecksumFile() with a short hash should fail")
+	}
+}
@@ -1,9 +1,56 @@
 package util
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
-//ParseImageAndTag parse image repo
-func ParseImageAndTag(repo string) (string, string) {
-	arr := strings.Split(repo, ":")
-	return arr[0], arr[1]
+// ParseSize 解析带单位的大小，例如 1024、500M、1G、2GiB，单位按 1024 进制计算
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	multiplier := int64(1)
+	if str != "" {
+		switch str[len(str)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// FormatRate 把每秒字节数格式化成便于阅读的速度，0 表示不限速
+func FormatRate(n int64) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return FormatSize(n) + "/s"
+}
+
+// FormatSize 把字节数格式化成便于阅读的大小
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
 }
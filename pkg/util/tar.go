@@ -2,12 +2,22 @@ package util
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
 )
 
 // Decompress 解压 tar.gz 保留原始的层级结构和文件修改时间
@@ -18,51 +28,166 @@ import (
 // Decompress 解压 Docker 镜像包到指定的临时目录
 // Decompress 解压 tar 文件到指定的临时目录
 func Decompress(tarPath, tmpDir string) error {
-    // 打开 tar 文件
-    file, err := os.Open(tarPath)
-    if err != nil {
-        return fmt.Errorf("failed to open file %s: %w", tarPath, err)
-    }
-    defer file.Close()
-
-    // 创建 tar 读取器
-    tr := tar.NewReader(file)
-
-    // 解压每个文件
-    for {
-        header, err := tr.Next()
-        if err == io.EOF {
-            break // 结束
-        }
-        if err != nil {
-            return fmt.Errorf("failed to read tar header: %w", err)
-        }
-
-        // 计算解压后的文件路径
-        targetPath := filepath.Join(tmpDir, header.Name)
-
-        // 创建目录或文件
-        switch header.Typeflag {
-        case tar.TypeDir:
-            // 创建目录
-            if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
-                return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
-            }
-        case tar.TypeReg:
-            // 创建文件
-            outFile, err := os.Create(targetPath)
-            if err != nil {
-                return fmt.Errorf("failed to create file %s: %w", targetPath, err)
-            }
-            defer outFile.Close()
-
-            // 将内容写入文件
-            if _, err := io.Copy(outFile, tr); err != nil {
-                return fmt.Errorf("failed to write file %s: %w", targetPath, err)
-            }
-        }
-    }
-    return nil
+	// 打开 tar 文件
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", tarPath, err)
+	}
+	defer file.Close()
+	return DecompressReader(file, filepath.Base(tarPath), tmpDir)
+}
+
+// ExtractArchive 解压镜像包（包括分卷包）到指定的临时目录
+func ExtractArchive(archive *Archive, tmpDir string) error {
+	r, err := archive.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := DecompressReader(r, archive.Name, tmpDir); err != nil {
+		return err
+	}
+	// tar 结束标记后面可能还有填充数据，读完整个数据流才能触发 sha256 校验
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DecompressReader 从数据流解压 tar、tar.gz、tar.bz2、tar.xz、tar.zst、tar.lz4、tar.sz、tar.br、zip、rar 到指定的临时目录
+//
+// 按文件头的魔数识别格式，brotli 没有魔数，只能按文件名 name 的扩展名（.tar.br、.tbr）识别
+func DecompressReader(r io.Reader, name, tmpDir string) error {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	magic, _ := br.Peek(10)
+	switch {
+	// zip 魔数 PK 03 04
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return decompressZip(br, tmpDir)
+	// rar 魔数 Rar! 1a 07
+	case bytes.HasPrefix(magic, []byte("Rar!\x1a\x07")):
+		return decompressRar(br, tmpDir)
+	// gzip 魔数 1f 8b
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		src = gz
+	// bzip2 魔数 BZh
+	case len(magic) >= 3 && string(magic[:3]) == "BZh":
+		src = bzip2.NewReader(br)
+	// xz 魔数 fd 37 7a 58 5a 00
+	case bytes.HasPrefix(magic, []byte("\xfd7zXZ\x00")):
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to open xz stream: %w", err)
+		}
+		src = xzr
+	// zstd 魔数 28 b5 2f fd
+	case bytes.HasPrefix(magic, []byte("\x28\xb5\x2f\xfd")):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		defer zr.Close()
+		src = zr
+	// lz4 魔数 04 22 4d 18
+	case bytes.HasPrefix(magic, []byte("\x04\x22\x4d\x18")):
+		src = lz4.NewReader(br)
+	// snappy 分帧格式以 stream identifier 开头：ff 06 00 00 sNaPpY
+	case bytes.HasPrefix(magic, []byte("\xff\x06\x00\x00sNaPpY")):
+		src = snappy.NewReader(br)
+	case isBrotliName(name):
+		src = brotli.NewReader(br)
+	}
+
+	// 创建 tar 读取器
+	tr := tar.NewReader(src)
+
+	// 解压每个文件
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break // 结束
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		// 计算解压后的文件路径，不允许通过 .. 或者符号链接写到临时目录以外
+		targetPath, err := SafeJoin(tmpDir, header.Name)
+		if err != nil {
+			return fmt.Errorf("illegal file path in archive: %w", err)
+		}
+
+		// 创建目录或文件
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// 创建目录
+			if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+			}
+		case tar.TypeReg:
+			if err := writeFile(targetPath, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := makeSymlink(tmpDir, targetPath, header.Name, header.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkPath, err := SafeJoin(tmpDir, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("illegal hard link in archive: %w", err)
+			}
+			if _, err := makeDir(filepath.Dir(targetPath)); err != nil {
+				return err
+			}
+			if err := os.Link(linkPath, targetPath); err != nil {
+				return fmt.Errorf("failed to create hard link %s: %w", targetPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isBrotliName 按扩展名判断是否是 brotli 压缩的 tar
+func isBrotliName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".tar.br") || strings.HasSuffix(name, ".tbr")
+}
+
+// writeFile 创建文件并写入内容
+func writeFile(targetPath string, r io.Reader) error {
+	outFile, err := createFile(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+	}
+
+	// 将内容写入文件
+	_, err = io.Copy(outFile, r)
+	outFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+	}
+	return nil
+}
+
+// makeSymlink docker save 会用符号链接表示重复的层，只允许指向临时目录内部
+func makeSymlink(tmpDir, targetPath, name, linkname string) error {
+	if filepath.IsAbs(linkname) || !Within(tmpDir, filepath.Join(filepath.Dir(targetPath), linkname)) {
+		return fmt.Errorf("illegal symlink in archive: %w", unsafePath(tmpDir, name+" -> "+linkname, "symlink escapes root"))
+	}
+	if _, err := makeDir(filepath.Dir(targetPath)); err != nil {
+		return err
+	}
+	if err := os.Symlink(linkname, targetPath); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %w", targetPath, err)
+	}
+	return nil
 }
 
 func remodifyTime(name string, modTime time.Time) {
@@ -89,7 +214,7 @@ func makeDir(name string) (string, error) {
 }
 
 func createFile(name string) (*os.File, error) {
-	dir := path.Dir(name)
+	dir := filepath.Dir(name)
 	if dir != "" {
 		_, err := os.Lstat(dir)
 		if err != nil {
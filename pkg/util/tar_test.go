@@ -0,0 +1,98 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// testEntry 测试用的 tar 条目，linkname 不为空时是符号链接，hardlink 为 true 时是硬链接
+type testEntry struct {
+	name     string
+	body     string
+	linkname string
+	hardlink bool
+}
+
+func makeTar(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			header = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+			if e.hardlink {
+				header.Typeflag = tar.TypeLink
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressReaderFormats(t *testing.T) {
+	data := makeTar(t, testEntry{name: "manifest.json", body: `[{"Config":"config.json"}]`}, testEntry{name: "layer/layer.tar", body: "layer"})
+	tests := []struct {
+		name      string
+		newWriter func(io.Writer) (io.WriteCloser, error)
+	}{
+		{"images.tar", nil},
+		{"images.tar.gz", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }},
+		{"images.tar.xz", func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }},
+		{"images.tar.zst", func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }},
+		{"images.tar.lz4", func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil }},
+		{"images.tar.sz", func(w io.Writer) (io.WriteCloser, error) { return snappy.NewBufferedWriter(w), nil }},
+		{"images.tar.br", func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil }},
+		{"images.tbr", func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil }},
+	}
+	for _, tt := range tests {
+		archive := data
+		if tt.newWriter != nil {
+			archive = compress(t, data, tt.newWriter)
+		}
+		dir := t.TempDir()
+		if err := DecompressReader(bytes.NewReader(archive), tt.name, dir); err != nil {
+			t.Errorf("%s: DecompressReader() error: %v", tt.name, err)
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "layer", "layer.tar"))
+		if err != nil || string(got) != "layer" {
+			t.Errorf("%s: layer/layer.tar = %q, %v", tt.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nwaples/rardecode"
+)
+
+// decompressZip 解压 zip 格式的镜像包，zip 需要随机读取，先把数据流写到临时目录的文件里
+func decompressZip(r io.Reader, tmpDir string) error {
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(tmpDir, ".archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("failed to read zip archive: %w", err)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return fmt.Errorf("failed to open zip archive: %w", err)
+	}
+	for _, file := range zr.File {
+		// 计算解压后的文件路径，不允许通过 .. 或者符号链接写到临时目录以外
+		targetPath, err := SafeJoin(tmpDir, file.Name)
+		if err != nil {
+			return fmt.Errorf("illegal file path in archive: %w", err)
+		}
+		if err := extractZipFile(file, tmpDir, targetPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(file *zip.File, tmpDir, targetPath string) error {
+	mode := file.Mode()
+	if mode.IsDir() {
+		if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+		}
+		return nil
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s in zip archive: %w", file.Name, err)
+	}
+	defer rc.Close()
+	if mode&os.ModeSymlink != 0 {
+		// zip 里符号链接的内容是链接的目标
+		link, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", file.Name, err)
+		}
+		return makeSymlink(tmpDir, targetPath, file.Name, string(link))
+	}
+	if !mode.IsRegular() {
+		return nil
+	}
+	return writeFile(targetPath, rc)
+}
+
+// decompressRar 解压 rar 格式的镜像包，不支持加密和分卷的 rar
+func decompressRar(r io.Reader, tmpDir string) error {
+	rr, err := rardecode.NewReader(r, "")
+	if err != nil {
+		return fmt.Errorf("failed to open rar archive: %w", err)
+	}
+	for {
+		header, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read rar header: %w", err)
+		}
+		// rar 在 windows 上打包时可能使用反斜杠
+		name := strings.ReplaceAll(header.Name, `\`, "/")
+		targetPath, err := SafeJoin(tmpDir, name)
+		if err != nil {
+			return fmt.Errorf("illegal file path in archive: %w", err)
+		}
+		if header.IsDir {
+			if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+			}
+			continue
+		}
+		if err := writeFile(targetPath, rr); err != nil {
+			return err
+		}
+	}
+}
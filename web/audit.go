@@ -0,0 +1,128 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"docker-tar-push-ui/pkg/audit"
+	"docker-tar-push-ui/pkg/auth"
+	"docker-tar-push-ui/pkg/push"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
+	"github.com/silenceper/log"
+)
+
+var auditLog *audit.Logger // 为 nil 时不记录审计日志
+
+// setupAudit 打开审计日志，file 为空时不记录
+func setupAudit(file string, maxSize int64, maxBackups int) error {
+	if file == "" {
+		log.Warnf("audit log is disabled")
+		return nil
+	}
+	l, err := audit.New(file, maxSize, maxBackups)
+	if err != nil {
+		return err
+	}
+	auditLog = l
+	log.Infof("audit log: %s", file)
+	return nil
+}
+
+// actor 发起操作的用户、来源 IP 和工作空间
+type actor struct {
+	Identity  *auth.Identity
+	IP        string
+	Workspace string
+}
+
+func (a actor) username() string {
+	if a.Identity != nil {
+		return a.Identity.Username
+	}
+	return ""
+}
+
+func requestActor(c *gin.Context) actor {
+	return actor{Identity: identityOf(c), IP: c.ClientIP(), Workspace: workspaceOf(c)}
+}
+
+// sessionActor WebSocket 连接建立时记录的用户
+func sessionActor(s *melody.Session) actor {
+	t := terminalOf(s)
+	return actor{Identity: t.Identity, IP: t.IP, Workspace: t.Workspace}
+}
+
+// recordAudit 补充用户信息后写入审计日志
+func recordAudit(a actor, e audit.Event) {
+	e.User = a.username()
+	e.IP = a.IP
+	e.Workspace = a.Workspace
+	auditLog.Record(e)
+}
+
+// recordPushResults 每个镜像的推送结果写一条审计记录
+func recordPushResults(a actor, imagePush *push.ImagePush, archiveSha256 func(name string) string) {
+	for _, result := range imagePush.Results() {
+		e := audit.Event{
+			Action:     audit.ActionPush,
+			Result:     audit.ResultSuccess,
+			Archive:    result.Archive,
+			Sha256:     archiveSha256(result.Archive),
+			Registry:   imagePush.Registry(),
+			Repository: result.Repository,
+			Tag:        result.Tag,
+			Digest:     result.Digest,
+			Error:      result.Error,
+		}
+		if result.Error != "" {
+			e.Result = audit.ResultFailure
+		}
+		recordAudit(a, e)
+	}
+}
+
+// auditQueryHandler 查询审计日志，最新的记录在前
+//
+//	GET /api/v1/audit?action=push&user=bob&result=failure&since=2024-01-01T00:00:00Z&limit=100
+func auditQueryHandler(c *gin.Context) {
+	if auditLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "audit log is disabled"})
+		return
+	}
+	filter := audit.Filter{
+		Action: c.Query("action"),
+		User:   c.Query("user"),
+		Result: c.Query("result"),
+		Limit:  100,
+	}
+	for key, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + key + ", RFC3339 is required"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		filter.Limit = limit
+	}
+	events, err := auditLog.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,298 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"docker-tar-push-ui/pkg/audit"
+	"docker-tar-push-ui/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+const (
+	sessionCookie   = "dtp_session"
+	oidcStateCookie = "dtp_oidc_state"
+)
+
+var (
+	authConfig *auth.Config // 为 nil 时表示没有开启认证
+	sessions   *auth.Sessions
+	oidcClient *auth.OIDC
+)
+
+// 不需要登录就可以访问的路径
+var publicPaths = []string{"/login", "/auth/", "/static/static/", "/healthz", "/readyz", "/api/v1/openapi.yaml"}
+
+// setupAuth 加载认证配置，file 为空时不开启认证
+func setupAuth(file string) error {
+	if file == "" {
+		log.Warnf("authentication is disabled, use --auth-config to enable it")
+		return nil
+	}
+	cfg, err := auth.LoadConfig(file)
+	if err != nil {
+		return err
+	}
+	authConfig = cfg
+	sessions = auth.NewSessions(cfg.SessionTTL)
+	if cfg.OIDC != nil && cfg.OIDC.Issuer != "" {
+		oidcClient = auth.NewOIDC(cfg.OIDC)
+	}
+	log.Infof("authentication enabled: %d users, %d tokens, oidc: %v", len(cfg.Users), len(cfg.Tokens), oidcClient != nil)
+	return nil
+}
+
+// authMiddleware 所有路由（包括 WebSocket 握手）都需要登录，支持会话 cookie 和 Authorization: Bearer <token>
+func authMiddleware(c *gin.Context) {
+	if authConfig == nil {
+		c.Next()
+		return
+	}
+	if identity := authenticate(c); identity != nil {
+		c.Set("identity", identity)
+		c.Next()
+		return
+	}
+	for _, p := range publicPaths {
+		if strings.HasPrefix(c.Request.URL.Path, p) {
+			c.Next()
+			return
+		}
+	}
+	// 浏览器打开页面时跳转到登录页，接口直接返回 401
+	if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, "/login")
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+func authenticate(c *gin.Context) *auth.Identity {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		if identity, ok := authConfig.AuthenticateToken(strings.TrimPrefix(header, "Bearer ")); ok {
+			return identity
+		}
+		return nil
+	}
+	if id, err := c.Cookie(sessionCookie); err == nil {
+		if identity, ok := sessions.Get(id); ok {
+			return identity
+		}
+	}
+	return nil
+}
+
+// identityOf 当前登录的用户，没有开启认证时为 nil
+func identityOf(c *gin.Context) *auth.Identity {
+	if v, ok := c.Get("identity"); ok {
+		return v.(*auth.Identity)
+	}
+	return nil
+}
+
+// requireAdmin 开启认证后只有管理员可以访问
+func requireAdmin(c *gin.Context) {
+	if authConfig != nil && !identityOf(c).IsAdmin() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+		return
+	}
+	c.Next()
+}
+
+// authorize 检查当前用户的权限，没有开启认证时不检查，拒绝的请求会记录到审计日志
+func authorize(a actor, action, registry, repository string) error {
+	if authConfig == nil {
+		return nil
+	}
+	if err := authConfig.Authorize(a.Identity, action, registry, repository); err != nil {
+		recordDenied(a, action, registry, repository, err)
+		return err
+	}
+	return nil
+}
+
+// authorizePrefix 推送前先检查仓库地址和镜像前缀，解析完镜像包后再按仓库逐个检查
+func authorizePrefix(a actor, action, registry, prefix string) error {
+	if authConfig == nil {
+		return nil
+	}
+	if err := authConfig.AuthorizePrefix(a.Identity, action, registry, prefix); err != nil {
+		recordDenied(a, action, registry, prefix, err)
+		return err
+	}
+	return nil
+}
+
+// requireAction 开启认证后需要拥有对应操作权限的角色才能访问
+func requireAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := authorize(requestActor(c), action, "", ""); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+func recordDenied(a actor, action, registry, repository string, err error) {
+	log.Warnf("permission denied: user=%s ip=%s action=%s: %v", a.username(), a.IP, action, err)
+	recordAudit(a, audit.Event{
+		Action:     action,
+		Result:     audit.ResultDenied,
+		Registry:   registry,
+		Repository: repository,
+		Error:      err.Error(),
+	})
+}
+
+var invalidWorkspaceChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// identityWorkspace 用户的工作空间，没有配置时使用用户名
+func identityWorkspace(identity *auth.Identity) string {
+	ws := identity.Workspace
+	if ws == "" {
+		ws = strings.TrimLeft(invalidWorkspaceChars.ReplaceAllString(identity.Username, "-"), "._-")
+	}
+	if !workspaceRe.MatchString(ws) {
+		return defaultWorkspace
+	}
+	return ws
+}
+
+func setSessionCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, value, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+func loginPageHandler(c *gin.Context) {
+	c.FileFromFS("login.html", http.FS(staticFiles))
+}
+
+// loginHandler 本地账号密码登录，支持 JSON 和表单
+func loginHandler(c *gin.Context) {
+	if authConfig == nil {
+		c.JSON(http.StatusOK, gin.H{"message": "authentication is disabled"})
+		return
+	}
+	var req struct {
+		Username string `json:"username" form:"username"`
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	identity, ok := authConfig.Authenticate(req.Username, req.Password)
+	if !ok {
+		log.Warnf("login failed for user %s from %s", req.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+		return
+	}
+	setSessionCookie(c, sessions.Create(identity), int(sessions.TTL().Seconds()))
+	log.Infof("user %s logged in from %s", identity.Username, c.ClientIP())
+	c.JSON(http.StatusOK, identity)
+}
+
+func logoutHandler(c *gin.Context) {
+	if id, err := c.Cookie(sessionCookie); err == nil && sessions != nil {
+		sessions.Delete(id)
+	}
+	setSessionCookie(c, "", -1)
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// meHandler 当前登录的用户，未登录时只返回认证方式
+func meHandler(c *gin.Context) {
+	resp := gin.H{"authEnabled": authConfig != nil, "oidc": oidcClient != nil}
+	if authConfig != nil {
+		if identity := authenticate(c); identity != nil {
+			resp["user"] = identity
+			resp["workspace"] = identityWorkspace(identity)
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// oidcLoginHandler 跳转到 OIDC issuer 登录
+func oidcLoginHandler(c *gin.Context) {
+	if oidcClient == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "oidc is not configured"})
+		return
+	}
+	state, nonce := randomString(), randomString()
+	redirect, err := oidcClient.AuthCodeURL(c.Request.Context(), state, nonce)
+	if err != nil {
+		log.Errorf("oidc login failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state+"."+nonce, 600, "/auth/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// oidcCallbackHandler issuer 登录完成后回调，校验 state 和 id_token 后创建会话
+func oidcCallbackHandler(c *gin.Context) {
+	if oidcClient == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "oidc is not configured"})
+		return
+	}
+	cookie, err := c.Cookie(oidcStateCookie)
+	parts := strings.SplitN(cookie, ".", 2)
+	if err != nil || len(parts) != 2 || parts[0] != c.Query("state") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid oidc state"})
+		return
+	}
+	c.SetCookie(oidcStateCookie, "", -1, "/auth/oidc", "", c.Request.TLS != nil, true)
+	if errMsg := c.Query("error"); errMsg != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errMsg, "description": c.Query("error_description")})
+		return
+	}
+	identity, err := oidcClient.Exchange(c.Request.Context(), c.Query("code"), parts[1])
+	if err != nil || identity.Username == "" {
+		log.Errorf("oidc callback failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc login failed"})
+		return
+	}
+	setSessionCookie(c, sessions.Create(identity), int(sessions.TTL().Seconds()))
+	log.Infof("user %s logged in via oidc from %s", identity.Username, c.ClientIP())
+	c.Redirect(http.StatusFound, "/")
+}
+
+// checkOrigin WebSocket 只允许同源或者配置里允许的来源，防止跨站 WebSocket 劫持
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// 非浏览器客户端不会带 Origin
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if authConfig != nil {
+		for _, allowed := range authConfig.AllowedOrigins {
+			if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+				return true
+			}
+		}
+	}
+	log.Warnf("rejected websocket connection from origin %s", origin)
+	return false
+}
@@ -0,0 +1,115 @@
+package web
+
+import (
+	"net/http"
+	"sync"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+// 限速分三级：全局（globalLimiter）、仓库配置、单个任务，上传时同时受三者限制
+var (
+	profileLimitersMu sync.Mutex
+	// profileLimiters 使用同一个仓库配置的任务共享带宽，例如到某个远程机房的专线
+	profileLimiters = map[string]*util.RateLimiter{}
+)
+
+// bandwidthRequest 调整限速的请求体，大小格式同配置文件，例如 10M，0 表示不限速
+type bandwidthRequest struct {
+	MaxBandwidth string `json:"maxBandwidth"`
+}
+
+// parseBandwidth 解析每秒的上传带宽，空字符串表示不限速
+func parseBandwidth(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return util.ParseSize(s)
+}
+
+// profileLimiter 仓库配置的限速器，第一次使用时按配置里的 maxBandwidth 创建
+func profileLimiter(name string) *util.RateLimiter {
+	if name == "" {
+		return nil
+	}
+	profileLimitersMu.Lock()
+	defer profileLimitersMu.Unlock()
+	if l, ok := profileLimiters[name]; ok {
+		return l
+	}
+	var limit int64
+	if p, err := profiles.Get(name); err == nil {
+		limit, _ = parseBandwidth(p.MaxBandwidth)
+	}
+	l := util.NewRateLimiter(limit)
+	profileLimiters[name] = l
+	return l
+}
+
+// setProfileBandwidth 仓库配置保存后更新限速，正在使用这个配置推送的任务立即生效
+func setProfileBandwidth(name string, limit int64) {
+	profileLimitersMu.Lock()
+	defer profileLimitersMu.Unlock()
+	if l, ok := profileLimiters[name]; ok {
+		l.SetLimit(limit)
+	}
+}
+
+// getBandwidthHandler 全局限速，每秒字节数
+func getBandwidthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"maxBandwidth": globalLimiter.Limit()})
+}
+
+// setBandwidthHandler 调整全局限速，正在进行的推送立即生效，重启后恢复为配置文件的值
+//
+//	PUT /api/v1/bandwidth {"maxBandwidth": "50M"}
+func setBandwidthHandler(c *gin.Context) {
+	var body bandwidthRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := parseBandwidth(body.MaxBandwidth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	globalLimiter.SetLimit(limit)
+	log.Infof("global bandwidth set to %s by %s", util.FormatRate(limit), usernameOf(c))
+	c.JSON(http.StatusOK, gin.H{"maxBandwidth": limit})
+}
+
+// setPushBandwidthHandler 调整单个任务的限速，排队中和正在推送的任务都可以调整；开启认证后只有发起任务的用户和管理员可以调整
+//
+//	PUT /api/v1/pushes/:id/bandwidth {"maxBandwidth": "5M"}
+func setPushBandwidthHandler(c *gin.Context) {
+	job := findJob(c)
+	if job == nil {
+		return
+	}
+	if !canManageJob(c, job) {
+		log.Warnf("%s is not allowed to change bandwidth of push job %s of %s", usernameOf(c), job.ID, job.User)
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner of the push job or an admin can change its bandwidth"})
+		return
+	}
+	var body bandwidthRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := parseBandwidth(body.MaxBandwidth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if job.done() {
+		c.JSON(http.StatusConflict, gin.H{"error": "push job already finished", "push": job.snapshot()})
+		return
+	}
+	job.setBandwidth(limit)
+	log.Infof("bandwidth of push job %s set to %s by %s", job.ID, util.FormatRate(limit), usernameOf(c))
+	c.JSON(http.StatusOK, job.snapshot())
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"path"
+
+	"docker-tar-push-ui/pkg/auth"
+	"docker-tar-push-ui/pkg/push"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+// checkRequest 测试连接的请求体，仓库地址、账号同推送请求，可以使用仓库配置
+type checkRequest struct {
+	pushRequest
+	// Repository 检查推送权限的仓库，为空时使用 镜像前缀/docker-tar-push-check
+	Repository string `json:"repository,omitempty"`
+	// Write 上传测试的 blob 和 manifest，检查跨仓库挂载和 OCI 格式
+	Write bool `json:"write,omitempty"`
+}
+
+// checkRegistryHandler 测试仓库的连接、证书、认证和推送权限
+//
+//	POST /api/v1/check {"profile": "harbor-prod"}
+func checkRegistryHandler(c *gin.Context) {
+	var body checkRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	repository := body.Repository
+	if repository == "" {
+		repository = path.Join(req.Prefix, push.CheckRepository)
+	}
+	a := requestActor(c)
+	if err := authorize(a, auth.ActionPush, req.Endpoint, repository); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	report := imagePush.Check(ctx, repository, body.Write)
+	log.Infof("registry check %s/%s by %s, ok: %v", req.Endpoint, repository, a.username(), report.OK)
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+// 上传文件的元数据（大小、sha256 等）保存在这个目录，.sha256 校验文件只保存用户上传的交付清单
+const metaDirName = ".meta"
+
+// fileMeta 上传文件的元数据
+type fileMeta struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Sha256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+func metaPath(dir, name string) string {
+	return path.Join(dir, metaDirName, name+".json")
+}
+
+func saveFileMeta(dir string, meta *fileMeta) error {
+	if err := os.MkdirAll(path.Join(dir, metaDirName), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath(dir, meta.Name), data, 0644)
+}
+
+func loadFileMeta(dir, name string) (*fileMeta, error) {
+	data, err := os.ReadFile(metaPath(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	meta := &fileMeta{}
+	return meta, json.Unmarshal(data, meta)
+}
+
+// normalizeChecksum 统一成小写的十六进制，兼容 sha256: 前缀
+func normalizeChecksum(sum string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(sum), "sha256:"))
+}
+
+// requestChecksum 从表单字段 sha256 或请求头 X-Checksum-Sha256 中获取期望的 sha256
+func requestChecksum(c *gin.Context) string {
+	if sum := c.PostForm("sha256"); sum != "" {
+		return normalizeChecksum(sum)
+	}
+	return normalizeChecksum(c.GetHeader("X-Checksum-Sha256"))
+}
+
+// sidecarChecksum 从已上传的 .sha256 校验文件中查找文件的期望 sha256
+//
+// 先找 <name>.sha256，分卷再找 <逻辑文件名>.sha256 里对应分片的记录
+func sidecarChecksum(dir, name string) string {
+	candidates := []string{name}
+	if base, _, _, ok := util.ParseSplitPart(name); ok {
+		candidates = append(candidates, base)
+	}
+	for _, candidate := range candidates {
+		sums, err := util.ReadChecksumFile(path.Join(dir, candidate+util.ChecksumSuffix))
+		if err != nil {
+			continue
+		}
+		if sum, ok := sums[name]; ok {
+			return sum
+		}
+		// 单行且没有文件名的校验文件
+		if sum, ok := sums[""]; ok && candidate == name {
+			return sum
+		}
+	}
+	return ""
+}
+
+// storeUploadedFile 把已经写完的临时文件校验后移动到上传目录并记录 sha256
+//
+// expected 为空时会用已上传的 .sha256 校验文件校验；上传的是 .sha256 校验文件时会反过来校验已经上传的文件
+// 校验失败时删除临时文件，移动失败时保留，由调用方决定是否删除
+func storeUploadedFile(dir, tmpPath, name string, size int64, sum, expected string) (int, error) {
+	if util.IsChecksumFile(name) {
+		return storeChecksumFile(dir, tmpPath, name)
+	}
+	if expected == "" {
+		expected = sidecarChecksum(dir, name)
+	}
+	if expected != "" && expected != sum {
+		os.Remove(tmpPath)
+		log.Errorf("upload %s checksum mismatch, expected %s, got %s", name, expected, sum)
+		return http.StatusUnprocessableEntity, fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", name, expected, sum)
+	}
+	if err := os.Rename(tmpPath, path.Join(dir, name)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := saveFileMeta(dir, &fileMeta{Name: name, Size: size, Sha256: sum, UploadedAt: time.Now()}); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Infof("uploaded %s sha256:%s", name, sum)
+	return http.StatusOK, nil
+}
+
+// storeChecksumFile 保存 .sha256 校验文件，已经上传的文件与校验文件不一致时拒绝
+func storeChecksumFile(dir, tmpPath, name string) (int, error) {
+	sums, err := util.ReadChecksumFile(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return http.StatusBadRequest, err
+	}
+	for file, expected := range sums {
+		if file == "" {
+			file = strings.TrimSuffix(name, util.ChecksumSuffix)
+		}
+		meta, err := loadFileMeta(dir, file)
+		if err != nil {
+			continue
+		}
+		if meta.Sha256 != expected {
+			os.Remove(tmpPath)
+			log.Errorf("uploaded %s does not match %s, expected %s, got %s", file, name, expected, meta.Sha256)
+			return http.StatusUnprocessableEntity, fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", file, expected, meta.Sha256)
+		}
+	}
+	if err := os.Rename(tmpPath, path.Join(dir, name)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// archiveChecksum 镜像包的 sha256，分卷包取校验文件里整个数据流的记录
+func archiveChecksum(dir string, archive *util.Archive) string {
+	if !archive.Split {
+		if meta, err := loadFileMeta(dir, archive.Name); err == nil {
+			return meta.Sha256
+		}
+		return ""
+	}
+	if sums, err := util.ReadChecksumFile(archive.ChecksumPath()); err == nil {
+		return sums[archive.Name]
+	}
+	return ""
+}
+
+// archiveChecksumByName 按镜像包名称取 sha256，推送结果写审计日志时使用
+func archiveChecksumByName(dir, name string) string {
+	archives, err := util.FindArchives(path.Join(dir, name))
+	if err != nil || len(archives) != 1 {
+		return ""
+	}
+	return archiveChecksum(dir, archives[0])
+}
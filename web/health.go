@@ -0,0 +1,166 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
+	"github.com/silenceper/log"
+)
+
+var (
+	// minFreeDisk 上传目录和临时目录所在磁盘的可用空间低于这个值时不再就绪
+	minFreeDisk uint64 = 512 << 20
+
+	draining atomic.Bool // 收到停止信号后不再接受新的推送
+
+	jobsMu sync.Mutex
+	jobs   = map[*push.ImagePush]struct{}{}
+	jobsWg sync.WaitGroup
+)
+
+// errDraining 服务正在停止
+var errDraining = errors.New("服务正在停止，不接受新的推送")
+
+// startJob 登记一个推送任务，服务停止时会等待它结束
+func startJob(imagePush *push.ImagePush) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if draining.Load() {
+		return errDraining
+	}
+	jobs[imagePush] = struct{}{}
+	jobsWg.Add(1)
+	return nil
+}
+
+func finishJob(imagePush *push.ImagePush) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if _, ok := jobs[imagePush]; ok {
+		delete(jobs, imagePush)
+		jobsWg.Done()
+	}
+}
+
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyzHandler 上传目录和临时目录可写、磁盘空间足够时就绪
+func readyzHandler(c *gin.Context) {
+	checks := gin.H{}
+	ready := !draining.Load()
+	if !ready {
+		checks["draining"] = "server is shutting down"
+	}
+	for _, dir := range []string{uploadDir, push.TmpRoot} {
+		if err := checkDir(dir); err != nil {
+			checks[dir] = err.Error()
+			ready = false
+			continue
+		}
+		checks[dir] = "ok"
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "checks": checks})
+}
+
+// checkDir 目录可写并且磁盘可用空间足够
+func checkDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	free, err := util.DiskFree(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < minFreeDisk {
+		return fmt.Errorf("free disk %s is less than %s", util.FormatSize(int64(free)), util.FormatSize(int64(minFreeDisk)))
+	}
+	return nil
+}
+
+// sweepTmp 删除服务临时目录下推送留下的子目录（按推送开始时间命名），启动时还没有推送任务，剩下的都是上次异常退出留下的
+func sweepTmp() {
+	entries, err := os.ReadDir(push.TmpRoot)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, err := strconv.ParseInt(entry.Name(), 10, 64); err != nil || !entry.IsDir() {
+			continue
+		}
+		p := filepath.Join(push.TmpRoot, entry.Name())
+		if err := os.RemoveAll(p); err != nil {
+			log.Errorf("remove orphaned tmp dir %s failed: %v", p, err)
+			continue
+		}
+		log.Infof("removed orphaned tmp dir %s", p)
+	}
+}
+
+// shutdown 停止接受新的请求和推送，等待正在进行的推送在 timeout 内结束，超时后中断推送
+func shutdown(srv *http.Server, m *melody.Melody, timeout time.Duration) {
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("shutdown http server: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		jobsWg.Wait()
+		close(done)
+	}()
+	jobsMu.Lock()
+	log.Infof("waiting for %d running pushes to finish", len(jobs))
+	jobsMu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		jobsMu.Lock()
+		log.Warnf("shutdown timeout, stopping %d running pushes", len(jobs))
+		for imagePush := range jobs {
+			imagePush.Stop()
+		}
+		jobsMu.Unlock()
+		// 等待推送删除仓库上未完成的上传，已经上传的 layer 下次推送时会跳过
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			log.Warnf("pushes did not stop in time")
+		}
+	}
+	m.Close()
+	sweepTmp()
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	log.Infof("server stopped")
+}
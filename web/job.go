@@ -0,0 +1,514 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"docker-tar-push-ui/pkg/auth"
+	"docker-tar-push-ui/pkg/profile"
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
+	"github.com/silenceper/log"
+)
+
+// 推送任务的状态
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+const (
+	maxJobLogSize  = 1 << 20 // 每个任务最多保留的日志，超过后丢弃最早的部分
+	maxFinishedJob = 200     // 最多保留的已结束任务，超过后删除最早的
+)
+
+// pushJobStatus 任务的状态和推送结果，接口返回的内容
+type pushJobStatus struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Workspace string `json:"workspace"`
+	User      string `json:"user,omitempty"`
+	Archive   string `json:"archive"`
+	Profile   string `json:"profile,omitempty"`
+	Registry  string `json:"registry"`
+	Prefix    string `json:"prefix"`
+	// MaxBandwidth 任务的限速，每秒字节数，0 表示只受全局和仓库配置的限速
+	MaxBandwidth int64         `json:"maxBandwidth,omitempty"`
+	Results      []push.Result `json:"results"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	StartedAt    *time.Time    `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+}
+
+// pushJob 一次推送任务，终端命令和 REST 接口都通过它推送，日志同时写到任务和终端
+type pushJob struct {
+	pushJobStatus
+
+	mu        sync.Mutex
+	logs      []byte
+	dropped   int64           // 因为超过 maxJobLogSize 丢弃的日志字节数
+	terminal  *melody.Session // 从终端发起的任务，日志同时写到终端
+	imagePush *push.ImagePush
+	limiter   *util.RateLimiter
+	ready     chan struct{} // 排队的任务领到推送名额时关闭
+	canceled  chan struct{}
+	once      sync.Once
+}
+
+var (
+	pushJobsMu sync.Mutex
+	pushJobs   = map[string]*pushJob{}
+)
+
+// newPushJob 创建并登记推送任务
+func newPushJob(a actor, req *pushRequest, limit int64, terminal *melody.Session) *pushJob {
+	job := &pushJob{
+		pushJobStatus: pushJobStatus{
+			ID:           newUploadID(),
+			Status:       jobQueued,
+			Workspace:    a.Workspace,
+			User:         a.username(),
+			Archive:      req.Archive,
+			Profile:      req.Profile,
+			Registry:     req.Endpoint,
+			Prefix:       req.Prefix,
+			MaxBandwidth: limit,
+			Results:      []push.Result{},
+			CreatedAt:    time.Now(),
+		},
+		terminal: terminal,
+		limiter:  util.NewRateLimiter(limit),
+		ready:    make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+	pushJobsMu.Lock()
+	pushJobs[job.ID] = job
+	pruneJobs()
+	pushJobsMu.Unlock()
+	return job
+}
+
+// pruneJobs 删除最早结束的任务，调用方需要持有 pushJobsMu
+func pruneJobs() {
+	var finished []*pushJob
+	for _, job := range pushJobs {
+		if job.done() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJob {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJob] {
+		delete(pushJobs, job.ID)
+	}
+}
+
+// queueKey 排队时按用户轮流，没有开启认证时按工作空间
+func (job *pushJob) queueKey() string {
+	if job.User != "" {
+		return "user:" + job.User
+	}
+	return "workspace:" + job.Workspace
+}
+
+// Write 追加任务日志，终端还连接着时同时写到终端
+func (job *pushJob) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	job.logs = append(job.logs, p...)
+	if over := len(job.logs) - maxJobLogSize; over > 0 {
+		job.logs = append([]byte(nil), job.logs[over:]...)
+		job.dropped += int64(over)
+	}
+	terminal := job.terminal
+	job.mu.Unlock()
+	if terminal != nil && !terminal.IsClosed() {
+		terminal.Write(p)
+	}
+	return len(p), nil
+}
+
+// logsFrom 从 offset 开始的日志和下一次读取的 offset，offset 是从任务开始计算的字节数
+func (job *pushJob) logsFrom(offset int64) ([]byte, int64) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	end := job.dropped + int64(len(job.logs))
+	if offset < job.dropped {
+		offset = job.dropped
+	}
+	if offset > end {
+		offset = end
+	}
+	return append([]byte(nil), job.logs[offset-job.dropped:]...), end
+}
+
+func (job *pushJob) setStatus(status string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	now := time.Now()
+	job.Status = status
+	switch status {
+	case jobRunning:
+		job.StartedAt = &now
+	case jobSucceeded, jobFailed, jobCanceled:
+		job.FinishedAt = &now
+	}
+}
+
+func (job *pushJob) done() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.FinishedAt != nil
+}
+
+// snapshot 任务当前的状态，用于返回给客户端
+func (job *pushJob) snapshot() pushJobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := job.pushJobStatus
+	status.Results = append([]push.Result{}, job.Results...)
+	return status
+}
+
+// setBandwidth 调整任务的限速，正在上传的分片按新的速度继续
+func (job *pushJob) setBandwidth(limit int64) {
+	job.limiter.SetLimit(limit)
+	job.mu.Lock()
+	job.MaxBandwidth = limit
+	job.mu.Unlock()
+}
+
+// cancel 取消任务，排队中的任务直接结束，正在推送的任务立即中断
+func (job *pushJob) cancel() {
+	job.once.Do(func() {
+		close(job.canceled)
+		job.mu.Lock()
+		imagePush := job.imagePush
+		job.mu.Unlock()
+		if imagePush != nil {
+			imagePush.Cancel()
+		}
+	})
+}
+
+// run 执行推送，结束后记录审计日志
+func (job *pushJob) run(a actor, req *pushRequest, archivePath, dir string) {
+	imagePush := push.NewImagePush(archivePath, req.Endpoint, req.Prefix, req.Username, req.Password, req.SkipSSLVerify, job)
+	finish := func(status string, err error) {
+		if err != nil {
+			imagePush.Errorf("%v", err)
+		}
+		job.setStatus(status)
+	}
+	if req.CACert != "" {
+		if err := imagePush.SetCACert([]byte(req.CACert)); err != nil {
+			finish(jobFailed, errors.New("load ca certificate failed, "+err.Error()))
+			return
+		}
+	}
+	// startPush 已经检查过
+	strategy, chunkSize, _ := req.blobUpload()
+	imagePush.SetUploadStrategy(strategy, chunkSize)
+	tag, _ := push.ParseTag(req.Tag)
+	imagePush.SetTag(tag)
+	extraTags, _ := util.ParseTags(req.ExtraTags)
+	imagePush.SetExtraTags(extraTags)
+	imagePush.SetDigestOnly(req.DigestOnly)
+	imagePush.SetAuthorizer(func(repository string) error {
+		return authorize(a, auth.ActionPush, req.Endpoint, repository)
+	})
+	if err := startJob(imagePush); err != nil {
+		finish(jobFailed, err)
+		return
+	}
+	defer finishJob(imagePush)
+	queued := jobScheduler.acquire(job, func(waiting int) {
+		imagePush.Infof("推送任务较多，排队等待中，当前有 %d 个任务在排队...", waiting+1)
+	})
+	if !queued {
+		finish(jobCanceled, errors.New("任务已取消"))
+		return
+	}
+	defer jobScheduler.release()
+	imagePush.SetRateLimiters(globalLimiter, profileLimiter(req.Profile), job.limiter)
+
+	job.mu.Lock()
+	job.imagePush = imagePush
+	job.mu.Unlock()
+	// 排队期间被取消
+	select {
+	case <-job.canceled:
+		imagePush.Cancel()
+	default:
+	}
+	job.setStatus(jobRunning)
+	imagePush.Push(context.Background())
+	recordPushResults(a, imagePush, func(name string) string {
+		return archiveChecksumByName(dir, name)
+	})
+
+	results := imagePush.Results()
+	status := jobSucceeded
+	if len(results) == 0 {
+		status = jobFailed
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			status = jobFailed
+		}
+	}
+	if imagePush.Canceled() {
+		status = jobCanceled
+	}
+	job.mu.Lock()
+	job.Results = append(job.Results, results...)
+	job.mu.Unlock()
+	job.setStatus(status)
+	log.Infof("push job %s %s", job.ID, status)
+}
+
+// startPush 检查权限后在后台执行推送
+func startPush(a actor, req *pushRequest, dir string, terminal *melody.Session) (*pushJob, error) {
+	if draining.Load() {
+		return nil, errDraining
+	}
+	archivePath, err := resolveArchive(dir, req.Archive)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := util.FindArchives(archivePath); err != nil {
+		return nil, fmt.Errorf("镜像包 %s 不存在: %w", req.Archive, err)
+	}
+	if err := authorizePrefix(a, auth.ActionPush, req.Endpoint, req.Prefix); err != nil {
+		return nil, err
+	}
+	limit, err := parseBandwidth(req.MaxBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxBandwidth: %w", err)
+	}
+	if _, _, err := req.blobUpload(); err != nil {
+		return nil, err
+	}
+	if _, err := push.ParseTag(req.Tag); err != nil {
+		return nil, fmt.Errorf("invalid tag: %w", err)
+	}
+	extraTags, err := util.ParseTags(req.ExtraTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extraTags: %w", err)
+	}
+	if req.DigestOnly && len(extraTags) > 0 {
+		return nil, errors.New("extraTags can not be used with digestOnly")
+	}
+	log.Infof("离线镜像包: %s\n", archivePath)
+	log.Infof("镜像仓库地址: %s\n", req.Endpoint)
+	log.Infof("镜像前缀: %s\n", req.Prefix)
+	log.Infof("账号: %s\n", req.Username)
+	log.Infof("跳过HTTPS验证: %v\n", req.SkipSSLVerify)
+	job := newPushJob(a, req, limit, terminal)
+	go job.run(a, req, archivePath, dir)
+	return job, nil
+}
+
+// createPushHandler 创建推送任务
+//
+//	POST /api/v1/pushes {"archive": "nginx.tar", "profile": "harbor-prod"}
+func createPushHandler(c *gin.Context) {
+	var body pushRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Archive == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archive is required"})
+		return
+	}
+	req, status, err := resolvePushRequest(&body)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := startPush(requestActor(c), req, workspaceDir(c), nil)
+	if err != nil {
+		c.JSON(pushErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/api/v1/pushes/"+job.ID)
+	c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+// resolvePushRequest 指定了仓库配置（或者使用默认配置）时换成配置里的仓库地址和账号，返回出错时的状态码
+func resolvePushRequest(body *pushRequest) (*pushRequest, int, error) {
+	req := body
+	if body.Profile == "" && body.Endpoint == "" {
+		body.Profile = defaultProfile
+	}
+	if body.Profile != "" {
+		var err error
+		if req, err = profileRequest(body.Archive, body.Profile, body.Prefix); err != nil {
+			if errors.Is(err, profile.ErrNotFound) {
+				return nil, http.StatusNotFound, err
+			}
+			return nil, http.StatusBadRequest, err
+		}
+		req.MaxBandwidth = body.MaxBandwidth
+		if body.UploadStrategy != "" {
+			req.UploadStrategy = body.UploadStrategy
+		}
+		if body.UploadChunkSize != "" {
+			req.UploadChunkSize = body.UploadChunkSize
+		}
+		req.Tag = body.Tag
+		req.ExtraTags = body.ExtraTags
+		req.DigestOnly = body.DigestOnly
+	}
+	if req.Endpoint == "" {
+		return nil, http.StatusBadRequest, errors.New("endpoint or profile is required")
+	}
+	return req, 0, nil
+}
+
+func pushErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errDraining):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, auth.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// findJob 当前工作空间的任务
+func findJob(c *gin.Context) *pushJob {
+	pushJobsMu.Lock()
+	job, ok := pushJobs[c.Param("id")]
+	pushJobsMu.Unlock()
+	if !ok || job.Workspace != workspaceOf(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "push job not found"})
+		return nil
+	}
+	return job
+}
+
+// listPushesHandler 当前工作空间的推送任务，最新的在前
+func listPushesHandler(c *gin.Context) {
+	pushJobsMu.Lock()
+	list := make([]pushJobStatus, 0, len(pushJobs))
+	for _, job := range pushJobs {
+		if job.Workspace == workspaceOf(c) {
+			list = append(list, job.snapshot())
+		}
+	}
+	pushJobsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"pushes": list})
+}
+
+// getPushHandler 任务状态、每个镜像的推送结果和日志
+func getPushHandler(c *gin.Context) {
+	job := findJob(c)
+	if job == nil {
+		return
+	}
+	logs, _ := job.logsFrom(0)
+	c.JSON(http.StatusOK, gin.H{"push": job.snapshot(), "logs": string(logs)})
+}
+
+// pushLockHandler 任务推送的镜像的 digest 锁定文件，format 为 json（默认）、yaml 或者 kustomize
+// 只有所有镜像都推送成功时才返回，避免部署时用到不完整的锁定文件
+//
+//	GET /api/v1/pushes/:id/lock?format=kustomize
+func pushLockHandler(c *gin.Context) {
+	job := findJob(c)
+	if job == nil {
+		return
+	}
+	format, err := push.ParseLockFormat(c.DefaultQuery("format", string(push.LockJSON)), "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !job.done() {
+		c.JSON(http.StatusConflict, gin.H{"error": "push job is not finished"})
+		return
+	}
+	status := job.snapshot()
+	if status.Status != jobSucceeded {
+		c.JSON(http.StatusConflict, gin.H{"error": "push job " + status.Status + ", lock file is not available"})
+		return
+	}
+	for _, result := range status.Results {
+		if result.Error != "" {
+			c.JSON(http.StatusConflict, gin.H{"error": "some images failed to push, lock file is not available"})
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := push.NewLock(status.Registry, status.Results).Write(&buf, format); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	contentType := "application/yaml; charset=utf-8"
+	if format == push.LockJSON {
+		contentType = "application/json; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// pushLogsHandler 从 offset 开始的日志，响应头 X-Log-Offset 是下一次读取的 offset，用于持续跟踪日志
+func pushLogsHandler(c *gin.Context) {
+	job := findJob(c)
+	if job == nil {
+		return
+	}
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	logs, next := job.logsFrom(offset)
+	c.Header("X-Log-Offset", strconv.FormatInt(next, 10))
+	c.Header("X-Push-Status", job.snapshot().Status)
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", logs)
+}
+
+// canManageJob 发起任务的用户和管理员可以管理任务，没有开启认证时不限制
+func canManageJob(c *gin.Context, job *pushJob) bool {
+	if authConfig == nil {
+		return true
+	}
+	identity := identityOf(c)
+	return identity != nil && (identity.IsAdmin() || identity.Username == job.User)
+}
+
+// cancelPushHandler 取消任务，已经结束的任务返回 409；开启认证后只有发起任务的用户和管理员可以取消
+func cancelPushHandler(c *gin.Context) {
+	job := findJob(c)
+	if job == nil {
+		return
+	}
+	if !canManageJob(c, job) {
+		log.Warnf("%s is not allowed to cancel push job %s of %s", usernameOf(c), job.ID, job.User)
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner of the push job or an admin can cancel it"})
+		return
+	}
+	if job.done() {
+		c.JSON(http.StatusConflict, gin.H{"error": "push job already finished", "push": job.snapshot()})
+		return
+	}
+	job.cancel()
+	log.Infof("push job %s canceled by %s", job.ID, usernameOf(c))
+	c.JSON(http.StatusAccepted, job.snapshot())
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"docker-tar-push-ui/pkg/push"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheus 指标，推送相关的指标通过推送引擎的事件更新
+var (
+	uploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dtp_upload_bytes_total",
+		Help: "Bytes of archives received by the server.",
+	})
+	uploadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dtp_upload_request_duration_seconds",
+		Help:    "Duration of upload requests (whole file or one chunk).",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+	uploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_uploads_total",
+		Help: "Completed uploads by result.",
+	}, []string{"result"})
+	pushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_pushes_total",
+		Help: "Pushed images by registry and result.",
+	}, []string{"registry", "result"})
+	pushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dtp_push_duration_seconds",
+		Help:    "Duration of pushing an archive.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"registry", "result"})
+	blobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_blobs_total",
+		Help: "Layers and configs by registry, uploaded or skipped because they already exist.",
+	}, []string{"registry", "status"})
+	blobBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_blob_bytes_total",
+		Help: "Bytes of layers and configs by registry, uploaded or skipped.",
+	}, []string{"registry", "status"})
+	registryRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dtp_registry_request_duration_seconds",
+		Help:    "Latency of requests to registries by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry", "method", "code"})
+	registryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_registry_retries_total",
+		Help: "Requests retried after the registry asked for authentication.",
+	}, []string{"registry"})
+	tokenFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtp_token_fetches_total",
+		Help: "Bearer token requests by registry and result.",
+	}, []string{"registry", "result"})
+	activeJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dtp_active_jobs",
+		Help: "Pushes in progress.",
+	})
+	queuedJobs = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dtp_queued_jobs",
+		Help: "Pushes waiting for a free slot.",
+	}, func() float64 {
+		_, waiting := jobScheduler.stats()
+		return float64(waiting)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(uploadBytes, uploadDuration, uploadsTotal, pushesTotal, pushDuration,
+		blobsTotal, blobBytes, registryRequestDuration, registryRetries, tokenFetches, activeJobs, queuedJobs)
+	push.AddObserver(observePush)
+}
+
+// observePush 把推送引擎的事件转换成指标
+func observePush(e push.Event) {
+	registry := registryLabel(e.Registry)
+	switch e.Type {
+	case push.EventPushStarted:
+		activeJobs.Inc()
+	case push.EventPushFinished:
+		activeJobs.Dec()
+		pushDuration.WithLabelValues(registry, resultLabel(e.Err)).Observe(e.Duration.Seconds())
+	case push.EventImagePushed:
+		pushesTotal.WithLabelValues(registry, resultLabel(e.Err)).Inc()
+	case push.EventBlobUploaded, push.EventBlobSkipped:
+		status := "uploaded"
+		if e.Type == push.EventBlobSkipped {
+			status = "skipped"
+		}
+		blobsTotal.WithLabelValues(registry, status).Inc()
+		blobBytes.WithLabelValues(registry, status).Add(float64(e.Bytes))
+	case push.EventRequest:
+		code := strconv.Itoa(e.StatusCode)
+		if e.Err != nil {
+			code = "error"
+		}
+		registryRequestDuration.WithLabelValues(registry, e.Method, code).Observe(e.Duration.Seconds())
+	case push.EventRetry:
+		registryRetries.WithLabelValues(registry).Inc()
+	case push.EventToken:
+		tokenFetches.WithLabelValues(registry, resultLabel(e.Err)).Inc()
+	}
+}
+
+// registryLabel 只保留 host，避免带上路径等导致标签过多
+func registryLabel(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeUpload 记录一次上传请求收到的字节数和耗时
+func observeUpload(start time.Time, bytes int64) {
+	uploadBytes.Add(float64(bytes))
+	uploadDuration.Observe(time.Since(start).Seconds())
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
@@ -0,0 +1,256 @@
+package web
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"docker-tar-push-ui/pkg/profile"
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+var (
+	profiles       *profile.Store
+	defaultProfile string // 推送命令没有指定仓库地址时使用的仓库配置
+
+	// 上传 blob 的方式和分片大小，推送请求和仓库配置没有指定时使用
+	uploadStrategy        = push.UploadAuto
+	uploadChunkSize int64 = push.DefaultChunkSize
+)
+
+// setupProfiles 打开仓库配置文件，没有主密钥时只能保存不带密码的配置
+func setupProfiles(file, masterKeyFile string) error {
+	key, err := profile.LoadMasterKey(masterKeyFile)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		log.Warnf("master key is not configured, registry profiles can not store passwords")
+	}
+	profiles, err = profile.NewStore(file, key)
+	return err
+}
+
+func listProfilesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"profiles": profiles.List(), "encrypted": profiles.Encrypted(), "default": defaultProfile})
+}
+
+func getProfileHandler(c *gin.Context) {
+	p, err := profiles.Get(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// saveProfileHandler 新建或更新配置，password 为空时保留原来的密码
+func saveProfileHandler(c *gin.Context) {
+	var p profile.Profile
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.Name = c.Param("name")
+	saved, err := profiles.Save(p)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, _ := parseBandwidth(saved.MaxBandwidth)
+	setProfileBandwidth(saved.Name, limit)
+	log.Infof("registry profile %s saved by %s", saved.Name, usernameOf(c))
+	c.JSON(http.StatusOK, saved)
+}
+
+func deleteProfileHandler(c *gin.Context) {
+	name := c.Param("name")
+	if err := profiles.Delete(name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, profile.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("registry profile %s deleted by %s", name, usernameOf(c))
+	c.JSON(http.StatusOK, gin.H{"message": "profile " + name + " deleted"})
+}
+
+func usernameOf(c *gin.Context) string {
+	if identity := identityOf(c); identity != nil {
+		return identity.Username
+	}
+	return "anonymous"
+}
+
+// pushRequest 一次推送需要的参数，也是 POST /api/v1/pushes 的请求体
+//
+// 指定了 profile 时使用保存的仓库配置，prefix 不为空时覆盖配置里的镜像前缀
+type pushRequest struct {
+	Archive       string `json:"archive"`
+	Profile       string `json:"profile,omitempty"`
+	Endpoint      string `json:"endpoint,omitempty"`
+	Prefix        string `json:"prefix,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	SkipSSLVerify bool   `json:"skipSSLVerify,omitempty"`
+	CACert        string `json:"caCert,omitempty"`
+	MaxBandwidth  string `json:"maxBandwidth,omitempty"` // 这个任务的上传带宽（每秒），例如 10M
+	// UploadStrategy、UploadChunkSize 上传 blob 的方式和分片大小，为空时使用仓库配置或者服务的配置
+	UploadStrategy  string `json:"uploadStrategy,omitempty"`
+	UploadChunkSize string `json:"uploadChunkSize,omitempty"`
+	// Tag 替换镜像包里的 tag，例如 1.0；写成 app:1.0 时同时替换镜像名，镜像包里没有 tag 时必须指定
+	Tag string `json:"tag,omitempty"`
+	// ExtraTags 每个镜像推送完成后额外加上的 tag，逗号分隔，例如 latest,stable
+	ExtraTags string `json:"extraTags,omitempty"`
+	// DigestOnly 只按 digest 推送，不产生 tag，推送结果里的 digest 用于部署时固定镜像
+	DigestOnly bool `json:"digestOnly,omitempty"`
+}
+
+// blobUpload 推送请求使用的上传方式和分片大小，没有指定时使用服务的配置
+func (req *pushRequest) blobUpload() (push.UploadStrategy, int64, error) {
+	strategy, chunkSize := uploadStrategy, uploadChunkSize
+	if req.UploadStrategy != "" {
+		s, err := push.ParseUploadStrategy(req.UploadStrategy)
+		if err != nil {
+			return "", 0, err
+		}
+		strategy = s
+	}
+	if req.UploadChunkSize != "" {
+		n, err := util.ParseSize(req.UploadChunkSize)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid uploadChunkSize: %w", err)
+		}
+		chunkSize = n
+	}
+	return strategy, chunkSize, nil
+}
+
+// parsePushCommand 解析 docker-tar-push 命令，支持两种写法：
+//
+//	docker-tar-push 镜像包 仓库地址 镜像前缀 账号 密码 true
+//	docker-tar-push 镜像包 --profile harbor-prod [--prefix team-a]
+//
+// 配置了默认仓库配置时，可以省略 --profile；两种写法都可以加上 --max-bandwidth 10M 限速、--tag 1.0 替换 tag、--extra-tags latest 额外的 tag、--digest-only 只按 digest 推送
+func parsePushCommand(parts []string) (*pushRequest, error) {
+	args, bandwidth := takeArg(parts[1:], "--max-bandwidth")
+	args, tag := takeArg(args, "--tag")
+	args, extraTags := takeArg(args, "--extra-tags")
+	args, digestOnly := takeFlag(args, "--digest-only")
+	req, err := parsePushArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	req.MaxBandwidth = bandwidth
+	req.Tag = tag
+	req.ExtraTags = extraTags
+	req.DigestOnly = digestOnly
+	return req, nil
+}
+
+// takeArg 取出 name 参数（--name value 或者 --name=value），返回剩下的参数
+func takeArg(args []string, name string) ([]string, string) {
+	rest := make([]string, 0, len(args))
+	value := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == name && i+1 < len(args):
+			value = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], name+"="):
+			value = strings.TrimPrefix(args[i], name+"=")
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, value
+}
+
+// takeFlag 取出没有值的 name 参数，返回剩下的参数
+func takeFlag(args []string, name string) ([]string, bool) {
+	rest := make([]string, 0, len(args))
+	found := false
+	for _, arg := range args {
+		if arg == name {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+func parsePushArgs(args []string) (*pushRequest, error) {
+	usesProfile := defaultProfile != "" && len(args) < 6
+	for _, arg := range args {
+		if arg == "--profile" || strings.HasPrefix(arg, "--profile=") {
+			usesProfile = true
+		}
+	}
+	if !usesProfile {
+		if len(args) < 6 {
+			return nil, fmt.Errorf("请参考：docker-tar-push 镜像包 仓库地址 镜像前缀 账号 密码 true 或者 docker-tar-push 镜像包 --profile 配置名称")
+		}
+		return &pushRequest{
+			Archive:       args[0],
+			Endpoint:      args[1],
+			Prefix:        args[2],
+			Username:      args[3],
+			Password:      args[4],
+			SkipSSLVerify: args[5] == "true",
+		}, nil
+	}
+
+	fs := flag.NewFlagSet("docker-tar-push", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	name := fs.String("profile", defaultProfile, "registry profile")
+	prefix := fs.String("prefix", "", "override the default prefix of the profile")
+	archive := ""
+	// 镜像包可以写在参数前面，也可以写在后面
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		archive, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if archive == "" && fs.NArg() > 0 {
+		archive = fs.Arg(0)
+	}
+	if archive == "" {
+		return nil, fmt.Errorf("请指定镜像包")
+	}
+	return profileRequest(archive, *name, *prefix)
+}
+
+// profileRequest 使用保存的仓库配置推送，prefix 不为空时覆盖配置里的镜像前缀
+func profileRequest(archive, name, prefix string) (*pushRequest, error) {
+	p, err := profiles.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	req := &pushRequest{
+		Archive:         archive,
+		Profile:         p.Name,
+		Endpoint:        p.Endpoint,
+		Prefix:          p.Prefix,
+		Username:        p.Username,
+		Password:        p.Password,
+		SkipSSLVerify:   p.SkipSSLVerify,
+		CACert:          p.CACert,
+		UploadStrategy:  p.UploadStrategy,
+		UploadChunkSize: p.UploadChunkSize,
+	}
+	if prefix != "" {
+		req.Prefix = prefix
+	}
+	return req, nil
+}
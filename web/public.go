@@ -1,40 +1,103 @@
 package web
 
 import (
+	"crypto/sha256"
+	"docker-tar-push-ui/pkg/audit"
+	"docker-tar-push-ui/pkg/auth"
 	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/olahol/melody"
 	"github.com/silenceper/log"
 )
 
-//go:embed index.html test.html static/*
+//go:embed index.html login.html test.html openapi.yaml static/*
 var staticFiles embed.FS
 
 var (
-	uploadDir = "./uploads" // 工作路径
-	mu        sync.Mutex
+	uploadDir     = "./uploads" // 工作路径，每个工作空间一个子目录
+	maxUploadSize int64         // 单个文件的大小限制，0 表示不限制
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 允许所有来源
-	},
+// Options 服务启动参数，由 cmd 根据配置文件、环境变量和命令行参数生成
+type Options struct {
+	Listen          string              // 监听地址，例如 :8088
+	UploadDir       string              // 上传目录，每个工作空间一个子目录
+	TmpDir          string              // 临时目录，推送时解压镜像包
+	MaxUploadSize   int64               // 单个文件的大小限制，0 表示不限制
+	JobConcurrency  int                 // 同时进行的推送个数
+	DefaultProfile  string              // 推送命令没有指定仓库时使用的仓库配置
+	LogLevel        log.Level           // 日志级别
+	AuthConfig      string              // 认证配置文件，为空时不开启认证
+	ProfilesFile    string              // 镜像仓库配置文件
+	MasterKeyFile   string              // 加密仓库密码的主密钥文件
+	AuditLog        string              // 审计日志文件，为空时不记录
+	AuditMaxSize    int64               // 审计日志超过这个大小后轮转
+	AuditMaxBackups int                 // 保留的轮转文件个数
+	ShutdownTimeout time.Duration       // 停止时等待推送结束的时间
+	MinFreeDisk     uint64              // 就绪检查要求的最小磁盘可用空间
+	MaxBandwidth    int64               // 所有推送共享的上传带宽，每秒字节数，0 表示不限速
+	UploadStrategy  push.UploadStrategy // 上传 blob 的方式，仓库配置里可以单独指定
+	UploadChunkSize int64               // 分片上传的分片大小
+	MetricsPublic   bool                // 开启认证后 /metrics 仍然不需要认证
+	TLSCert         string              // 证书和私钥，配置后使用 https
+	TLSKey          string
+	TLSSelfSigned   bool   // 证书文件不存在时生成自签名证书
+	TLSClientCA     string // 配置后要求客户端证书
 }
 
-func Server(port string) {
+func Server(opts Options) {
+	log.SetLogLevel(opts.LogLevel)
+	if opts.LogLevel < log.LevelDebug {
+		gin.SetMode(gin.ReleaseMode)
+	}
 	r := gin.Default()
-	log.SetLogLevel(log.Level(log.LevelInfo))
+	uploadDir = opts.UploadDir
+	// 使用服务自己的子目录，启动时清理不会影响同一个临时目录下命令行的推送
+	push.TmpRoot = filepath.Join(opts.TmpDir, "docker-tar-push-server")
+	maxUploadSize = opts.MaxUploadSize
+	minFreeDisk = opts.MinFreeDisk
+	defaultProfile = opts.DefaultProfile
+	jobScheduler.setLimit(opts.JobConcurrency)
+	globalLimiter.SetLimit(opts.MaxBandwidth)
+	uploadStrategy, uploadChunkSize = opts.UploadStrategy, opts.UploadChunkSize
+	if err := setupAuth(opts.AuthConfig); err != nil {
+		log.Fatalf("load auth config failed: %v", err)
+	}
+	if err := setupProfiles(opts.ProfilesFile, opts.MasterKeyFile); err != nil {
+		log.Fatalf("load registry profiles failed: %v", err)
+	}
+	if err := setupAudit(opts.AuditLog, opts.AuditMaxSize, opts.AuditMaxBackups); err != nil {
+		log.Fatalf("open audit log failed: %v", err)
+	}
+	sweepTmp()
+	// 健康检查不需要认证
+	r.Use(authMiddleware)
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readyzHandler)
+	// 登录相关的接口不需要认证
+	r.GET("/login", loginPageHandler)
+	r.POST("/auth/login", loginHandler)
+	r.POST("/auth/logout", logoutHandler)
+	r.GET("/auth/me", meHandler)
+	r.GET("/auth/oidc/login", oidcLoginHandler)
+	r.GET("/auth/oidc/callback", oidcCallbackHandler)
+
 	// 首页接口
 	r.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "/static")
@@ -43,80 +106,221 @@ func Server(port string) {
 	// r.StaticFS("/files", http.FS(staticFiles))
 	r.StaticFS("/static", http.FS(staticFiles))
 
-	r.POST("/upload", uploadHandler)
+	// 接口文档
+	r.GET("/api/v1/openapi.yaml", func(c *gin.Context) {
+		c.FileFromFS("openapi.yaml", http.FS(staticFiles))
+	})
+
+	// prometheus 指标，开启认证后使用 API Token 抓取，或者配置 metricsPublic 后不需要认证
+	if opts.MetricsPublic {
+		publicPaths = append(publicPaths, "/metrics")
+	}
+	r.GET("/metrics", metricsHandler())
+
+	r.Use(workspaceMiddleware)
+	r.POST("/upload", requireAction(auth.ActionUpload), uploadHandler)
 	r.GET("/files", getImagesHandler)
-	r.DELETE("/files", deleteImagesHandler)
+	r.DELETE("/files", requireAction(auth.ActionDelete), deleteImagesHandler)
+	r.GET("/admin/files", requireAdmin, adminFilesHandler)
+
+	// 分片上传，支持断点续传
+	r.GET("/upload/sessions", listUploadsHandler)
+	r.POST("/upload/sessions", requireAction(auth.ActionUpload), createUploadHandler)
+	r.GET("/upload/sessions/:id", getUploadHandler)
+	r.HEAD("/upload/sessions/:id", getUploadHandler)
+	r.PATCH("/upload/sessions/:id", requireAction(auth.ActionUpload), patchUploadHandler)
+	r.POST("/upload/sessions/:id/complete", requireAction(auth.ActionUpload), completeUploadHandler)
+	r.DELETE("/upload/sessions/:id", deleteUploadHandler)
+
+	// 镜像仓库配置，密码加密保存，只有管理员可以修改
+	r.GET("/api/v1/profiles", listProfilesHandler)
+	r.GET("/api/v1/profiles/:name", getProfileHandler)
+	r.PUT("/api/v1/profiles/:name", requireAdmin, saveProfileHandler)
+	r.DELETE("/api/v1/profiles/:name", requireAdmin, deleteProfileHandler)
+
+	// 审计日志查询
+	r.GET("/api/v1/audit", requireAdmin, auditQueryHandler)
+
+	// 推送任务，接口说明见 /api/v1/openapi.yaml
+	r.GET("/api/v1/pushes", listPushesHandler)
+	r.POST("/api/v1/pushes", requireAction(auth.ActionPush), createPushHandler)
+	r.GET("/api/v1/pushes/:id", getPushHandler)
+	r.GET("/api/v1/pushes/:id/logs", pushLogsHandler)
+	r.GET("/api/v1/pushes/:id/lock", pushLockHandler)
+	r.DELETE("/api/v1/pushes/:id", requireAction(auth.ActionPush), cancelPushHandler)
+	r.PUT("/api/v1/pushes/:id/bandwidth", requireAction(auth.ActionPush), setPushBandwidthHandler)
+	r.GET("/api/v1/bandwidth", getBandwidthHandler)
+	r.PUT("/api/v1/bandwidth", requireAdmin, setBandwidthHandler)
+
+	// 测试仓库连接
+	r.POST("/api/v1/check", requireAction(auth.ActionPush), checkRegistryHandler)
+
+	// 浏览镜像仓库里的镜像、tag 和 manifest
+	r.POST("/api/v1/registry/catalog", requireAction(auth.ActionPush), registryCatalogHandler)
+	r.POST("/api/v1/registry/tags", requireAction(auth.ActionPush), registryTagsHandler)
+	r.POST("/api/v1/registry/manifest", requireAction(auth.ActionPush), registryManifestHandler)
+	r.POST("/api/v1/registry/tag", requireAction(auth.ActionPush), registryTagHandler)
+	r.POST("/api/v1/registry/delete", requireAction(auth.ActionDelete), registryDeleteHandler)
 
 	// WebSocket 路由
 	m := melody.New() // melody用于实现WebSocket功能
+	m.Upgrader.CheckOrigin = checkOrigin
+	// 在连接建立后，发送帮助信息
+	m.HandleConnect(func(s *melody.Session) {
+		log.Infof("New WebSocket connection established: %v", s)
+		// 发送帮助信息
+		if err := s.Write([]byte(help())); err != nil {
+			log.Errorf("Failed to send help message: %v", err)
+		}
+	})
+	m.HandleMessage(func(s *melody.Session, msg []byte) { // 处理来自WebSocket的消息
+		// 命令参数里可能有仓库密码，只记录命令名
+		if fields := strings.Fields(string(msg)); len(fields) > 0 {
+			log.Infof("Received command: %s", fields[0])
+		}
+		if err := handleCommand(s, string(msg)); err != nil {
+			log.Errorf("执行命令出错: %v", err)
+			s.Write([]byte(fmt.Sprintf("[ERROR]: %s\n", err)))
+		}
+	})
 	r.GET("/webterminal", func(c *gin.Context) {
-		// 在连接建立后，发送帮助信息
-		m.HandleConnect(func(s *melody.Session) {
-			log.Infof("New WebSocket connection established: %v", s)
-			// 发送帮助信息
-			if err := s.Write([]byte(help())); err != nil {
-				log.Errorf("Failed to send help message: %v", err)
-			}
-		})
-		m.HandleMessage(func(s *melody.Session, msg []byte) { // 处理来自WebSocket的消息
-			log.Infof("Received message: %s", msg)
-			if err := handleCommand(s, string(msg)); err != nil {
-				log.Errorf("执行命令出错: %v", err)
-				s.Write([]byte(fmt.Sprintf("[ERROR]: %s\n", err)))
-			}
+		// 访问 /webterminal 时将转交给melody处理，连接的工作空间在建立时确定
+		m.HandleRequestWithKeys(c.Writer, c.Request, map[string]interface{}{
+			terminalKey: &terminalState{Workspace: workspaceOf(c), Identity: identityOf(c), IP: c.ClientIP()},
 		})
-		m.HandleRequest(c.Writer, c.Request) // 访问 /webterminal 时将转交给melody处理
 	})
-	r.Run(":" + port)
+	srv := &http.Server{Addr: opts.Listen, Handler: r}
+	if opts.TLSCert != "" {
+		tlsConfig, err := serverTLSConfig(opts)
+		if err != nil {
+			log.Fatalf("load tls config failed: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			log.Infof("listening on https://%s", opts.Listen)
+			// 证书已经在 TLSConfig 里
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("listening on http://%s", opts.Listen)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen failed: %v", err)
+		}
+	}()
+	// 收到 SIGTERM 后优雅停止，等待正在进行的推送结束
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Infof("received %s, shutting down", sig)
+	shutdown(srv, m, opts.ShutdownTimeout)
 }
 
 func uploadHandler(c *gin.Context) {
+	start := time.Now()
+	if maxUploadSize > 0 {
+		// 多留一点给表单的其他字段
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1<<20)
+	}
 	imageFile, err := c.FormFile("file")
 	if err != nil {
 		log.Errorf("获取镜像包失败: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "获取镜像包失败"})
 		return
 	}
+	if maxUploadSize > 0 && imageFile.Size > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file is larger than " + util.FormatSize(maxUploadSize)})
+		return
+	}
 	log.Infof("离线镜像包: %s\n", imageFile.Filename)
-	c.SaveUploadedFile(imageFile, path.Join(uploadDir, imageFile.Filename))
-	c.JSON(http.StatusOK, gin.H{"message": "文件上传成功" + imageFile.Filename})
+	filename, err := util.SanitizeFileName(imageFile.Filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	src, err := imageFile.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer src.Close()
+	// 先写到临时文件，边写边计算 sha256，校验通过后再移动到上传目录
+	dir := workspaceDir(c)
+	if err := os.MkdirAll(partialDir(dir), 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tmpPath := path.Join(partialDir(dir), newUploadID()+".part")
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), src)
+	dst.Close()
+	observeUpload(start, size)
+	if err != nil {
+		os.Remove(tmpPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	event := audit.Event{Action: audit.ActionUpload, Result: audit.ResultSuccess, Archive: filename, Sha256: sum, Size: size}
+	if code, err := storeUploadedFile(dir, tmpPath, filename, size, sum, requestChecksum(c)); err != nil {
+		os.Remove(tmpPath)
+		event.Result, event.Error = audit.ResultFailure, err.Error()
+		recordUpload(c, event)
+		c.JSON(code, gin.H{"error": err.Error(), "sha256": sum})
+		return
+	}
+	recordUpload(c, event)
+	c.JSON(http.StatusOK, gin.H{"message": "文件上传成功" + filename, "sha256": sum})
 }
 
 func getImagesHandler(c *gin.Context) {
-	var records []map[string]string
-	files, err := os.ReadDir(uploadDir)
-	if err == nil {
-		for _, file := range files {
-			if !file.IsDir() {
-				record := map[string]string{
-					"name":    file.Name(),
-					"address": path.Join(uploadDir, file.Name()),
-				}
-				records = append(records, record)
-			}
-		}
-	}
-	c.JSON(http.StatusOK, records)
+	c.JSON(http.StatusOK, archiveRecords(workspaceDir(c)))
 }
 
+// deleteImagesHandler 删除当前工作空间的文件，带 name 参数时只删除这一个镜像包
 func deleteImagesHandler(c *gin.Context) {
-	// 确认要删除的目录
-	dirPath := uploadDir
+	dir := workspaceDir(c)
+	if name := c.Query("name"); name != "" {
+		event := audit.Event{Action: audit.ActionDelete, Result: audit.ResultSuccess, Archive: name}
+		sum, err := removeArchive(dir, name)
+		event.Sha256 = sum
+		if err != nil {
+			event.Result, event.Error = audit.ResultFailure, err.Error()
+			recordAudit(requestActor(c), event)
+			c.String(http.StatusInternalServerError, "Failed to delete file: %v", err)
+			return
+		}
+		recordAudit(requestActor(c), event)
+		c.String(http.StatusOK, "File %s deleted successfully", name)
+		return
+	}
 
-	// 删除目录及其内容
-	err := os.RemoveAll(dirPath)
+	// 删除工作空间目录及其内容，审计日志里 archive 为 * 表示整个工作空间
+	event := audit.Event{Action: audit.ActionDelete, Result: audit.ResultSuccess, Archive: "*"}
+	err := os.RemoveAll(dir)
 	if err != nil {
+		event.Result, event.Error = audit.ResultFailure, err.Error()
+		recordAudit(requestActor(c), event)
 		c.String(http.StatusInternalServerError, "Failed to delete files: %v", err)
 		return
 	}
+	recordAudit(requestActor(c), event)
 
 	// 返回成功响应
 	c.String(http.StatusOK, "All files deleted successfully")
 }
 
+// handleCommand 处理终端命令，melody 按顺序处理同一个连接的消息，不同连接之间互不影响
 func handleCommand(s *melody.Session, command string) error {
-	mu.Lock()
-	defer mu.Unlock()
+	t := terminalOf(s)
 	// 按空格切割命令
 	parts := strings.Fields(command)
 	if len(parts) == 0 {
@@ -126,39 +330,50 @@ func handleCommand(s *melody.Session, command string) error {
 
 	// 如果是退出指令，则优先判断
 	if cmd == "exit" {
-		s.Set("taskInProgress", false)
+		if job := t.activeJob(); job != nil {
+			job.cancel()
+		}
 		return nil
 	}
-	// 检查当前任务是否正在运行（只有长连接的请求，才会设置这个变量）
-	if inProgress, exists := s.Get("taskInProgress"); exists && inProgress.(bool) {
+	// 调整正在进行的推送的限速
+	if cmd == "limit" {
+		job := t.activeJob()
+		if job == nil {
+			return s.Write([]byte("当前没有正在进行的推送\n"))
+		}
+		if len(parts) < 2 {
+			return s.Write([]byte("请参考：limit 10M，limit 0 表示取消任务的限速\n"))
+		}
+		limit, err := parseBandwidth(parts[1])
+		if err != nil {
+			return err
+		}
+		job.setBandwidth(limit)
+		log.Infof("bandwidth of push job %s set to %s by %s", job.ID, util.FormatRate(limit), sessionActor(s).username())
+		return s.Write([]byte("任务 " + job.ID + " 限速已调整为 " + util.FormatRate(limit) + "\n"))
+	}
+	// 检查当前任务是否正在运行
+	if t.activeJob() != nil {
 		return fmt.Errorf("请等待上一个命令执行完毕")
 	}
 
 	switch cmd {
 	case "docker-tar-push":
-		if len(parts) < 7 {
-			return s.Write([]byte("请参考：docker-tar-push 镜像包 镜像前缀 镜像地址 账号 密码 ture\n")) // 发送帮助信息
+		req, err := parsePushCommand(parts)
+		if err != nil {
+			return s.Write([]byte(err.Error() + "\n")) // 发送帮助信息
 		}
-		log.Infof("离线镜像包: %s\n", parts[1])
-		log.Infof("镜像仓库地址: %s\n", parts[2])
-		log.Infof("镜像前缀: %s\n", parts[3])
-		log.Infof("账号: %s\n", parts[4])
-		// log.Infof("密码: %s\n", parts[5])
-		log.Infof("跳过HTTPS验证: %s\n", parts[6])
-		go func() {
-			s.Set("taskInProgress", true)
-			defer s.Set("taskInProgress", false)
-			skipSSLVerify := false
-			if parts[6] == "true" {
-				skipSSLVerify = true
+		job, err := startPush(sessionActor(s), req, sessionWorkspaceDir(s), s)
+		if err != nil {
+			if errors.Is(err, auth.ErrForbidden) {
+				return s.Write([]byte("[ERROR] " + err.Error() + "\n"))
 			}
-
-			imagePush := push.NewImagePush(parts[1], parts[2], parts[3], parts[4], parts[5], skipSSLVerify, s)
-			imagePush.Push()
-		}()
-		return s.Write([]byte("推送中\n")) // 发送帮助信息
+			return err
+		}
+		t.setJob(job)
+		return s.Write([]byte("推送中，任务 ID: " + job.ID + "\n")) // 发送帮助信息
 	case "ls":
-		return s.Write([]byte(listFiles(uploadDir)))
+		return s.Write([]byte(listFiles(sessionWorkspaceDir(s))))
 	case "help":
 		return s.Write([]byte(help()))
 	default:
@@ -180,21 +395,29 @@ Available commands:
 - help: Show this help message
 - ls: List files in the upload directory
 - docker-tar-push <args>: Execute docker-tar-push with the provided arguments
+- docker-tar-push <镜像包> --profile <配置名称> [--prefix <镜像前缀>]: 使用保存的镜像仓库配置推送
+- docker-tar-push ... --max-bandwidth 10M: 限制这次推送的上传带宽
+- limit <速度>: 调整正在进行的推送的限速，例如 limit 5M，limit 0 表示取消任务的限速
 - exit: 退出上一个命令
 `
 }
 
 func listFiles(dir string) []byte {
-	files, err := os.ReadDir(dir)
+	archives, err := listArchives(dir)
 	if err != nil {
 		return []byte(fmt.Sprintf("failed to list files: %v", err))
 	}
 
 	var fileList string
-	for _, file := range files {
-		// 获取文件的绝对路径
-		filePath := filepath.Join(uploadDir, file.Name())
-		fileList += filePath + "\n"
+	for _, archive := range archives {
+		fileList += archive.Path
+		if archive.Split {
+			fileList += fmt.Sprintf(" (%d parts)", len(archive.Parts))
+			if err := archive.Check(); err != nil {
+				fileList += " [ERROR] " + err.Error()
+			}
+		}
+		fileList += "\n"
 	}
 	return []byte(fileList)
 }
@@ -0,0 +1,320 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"docker-tar-push-ui/pkg/audit"
+	"docker-tar-push-ui/pkg/auth"
+	"docker-tar-push-ui/pkg/push"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+// registryTimeout 请求镜像仓库最长的时间，仓库地址不通时不让请求一直挂着
+const registryTimeout = 30 * time.Second
+
+// defaultPageSize 仓库列表和 tag 列表每页的数量
+const defaultPageSize = 50
+
+// browseRequest 浏览镜像仓库的请求体，仓库地址、账号同推送请求，可以使用仓库配置
+type browseRequest struct {
+	pushRequest
+	Repository string `json:"repository,omitempty"`
+	Reference  string `json:"reference,omitempty"` // tag 或者 digest
+	N          int    `json:"n,omitempty"`
+	Last       string `json:"last,omitempty"` // 上一页返回的 next
+	// Details 列出 tag 时同时获取每个 tag 的 digest、大小、架构和创建时间
+	Details bool `json:"details,omitempty"`
+	// Digest 删除时确认过的 digest，tag 已经指向别的镜像时拒绝删除
+	Digest string `json:"digest,omitempty"`
+	// Tags 加 tag 时新的 tag，只写 tag 时在同一个镜像里，也可以写 镜像:tag
+	Tags []string `json:"tags,omitempty"`
+}
+
+// registryClient 按请求（或者仓库配置）创建访问镜像仓库的客户端，出错时已经返回了错误信息
+func registryClient(c *gin.Context, body *pushRequest) (*push.ImagePush, *pushRequest, bool) {
+	req, status, err := resolvePushRequest(body)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	imagePush := push.NewImagePush("", req.Endpoint, req.Prefix, req.Username, req.Password, req.SkipSSLVerify, nil)
+	if req.CACert != "" {
+		if err := imagePush.SetCACert([]byte(req.CACert)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "load ca certificate failed, " + err.Error()})
+			return nil, nil, false
+		}
+	}
+	return imagePush, req, true
+}
+
+// registryErrorStatus 仓库返回的错误对应的状态码，仓库不通或者认证失败时返回 502
+func registryErrorStatus(err error) int {
+	var registryErr *push.RegistryError
+	if errors.As(err, &registryErr) {
+		switch registryErr.StatusCode {
+		case http.StatusNotFound, http.StatusForbidden, http.StatusMethodNotAllowed:
+			return registryErr.StatusCode
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// canBrowse 开启权限控制时只能看到可以推送的仓库
+func canBrowse(a actor, registry, repository string) bool {
+	return authConfig == nil || authConfig.Authorize(a.Identity, auth.ActionPush, registry, repository) == nil
+}
+
+func bindBrowseRequest(c *gin.Context) (*browseRequest, bool) {
+	var body browseRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if body.N <= 0 {
+		body.N = defaultPageSize
+	}
+	return &body, true
+}
+
+// registryCatalogHandler 镜像仓库里的镜像列表，没有权限的镜像不返回
+//
+//	POST /api/v1/registry/catalog {"profile": "harbor-prod", "last": ""}
+func registryCatalogHandler(c *gin.Context) {
+	body, ok := bindBrowseRequest(c)
+	if !ok {
+		return
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	repositories, next, err := imagePush.Catalog(ctx, body.N, body.Last)
+	if err != nil {
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	a := requestActor(c)
+	visible := make([]string, 0, len(repositories))
+	for _, repository := range repositories {
+		if canBrowse(a, req.Endpoint, repository) {
+			visible = append(visible, repository)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"registry": req.Endpoint, "repositories": visible, "next": next})
+}
+
+// registryTagsHandler 镜像的 tag 列表，details 为 true 时同时返回每个 tag 的 manifest 信息
+//
+//	POST /api/v1/registry/tags {"profile": "harbor-prod", "repository": "library/nginx", "details": true}
+func registryTagsHandler(c *gin.Context) {
+	body, ok := bindBrowseRequest(c)
+	if !ok {
+		return
+	}
+	if body.Repository == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository is required"})
+		return
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	if err := authorize(requestActor(c), auth.ActionPush, req.Endpoint, body.Repository); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	tags, next, err := imagePush.Tags(ctx, body.Repository, body.N, body.Last)
+	if err != nil {
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	result := gin.H{"registry": req.Endpoint, "repository": body.Repository, "tags": tags, "next": next}
+	if body.Details {
+		manifests := make([]*push.ManifestInfo, 0, len(tags))
+		for _, tag := range tags {
+			info, err := imagePush.Manifest(ctx, body.Repository, tag)
+			if err != nil {
+				info = &push.ManifestInfo{Repository: body.Repository, Reference: tag, Error: err.Error()}
+			}
+			manifests = append(manifests, info)
+		}
+		result["manifests"] = manifests
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// registryManifestHandler 镜像的 manifest，包括 digest、大小、架构和创建时间
+//
+//	POST /api/v1/registry/manifest {"profile": "harbor-prod", "repository": "library/nginx", "reference": "1.25"}
+func registryManifestHandler(c *gin.Context) {
+	body, ok := bindBrowseRequest(c)
+	if !ok {
+		return
+	}
+	if body.Repository == "" || body.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository and reference are required"})
+		return
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	if err := authorize(requestActor(c), auth.ActionPush, req.Endpoint, body.Repository); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	info, err := imagePush.Manifest(ctx, body.Repository, body.Reference)
+	if err != nil {
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// registryDeleteHandler 删除仓库里的镜像，tag 先解析成 digest 再删除 manifest，指向同一个 digest 的 tag 都会被删除
+//
+//	POST /api/v1/registry/delete {"profile": "harbor-prod", "repository": "library/nginx", "reference": "1.25", "digest": "sha256:..."}
+func registryDeleteHandler(c *gin.Context) {
+	body, ok := bindBrowseRequest(c)
+	if !ok {
+		return
+	}
+	if body.Repository == "" || body.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository and reference are required"})
+		return
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	a := requestActor(c)
+	if err := authorize(a, auth.ActionDelete, req.Endpoint, body.Repository); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	digest, err := imagePush.ResolveDigest(ctx, body.Repository, body.Reference)
+	if err != nil {
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if body.Digest != "" && body.Digest != digest {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s now points to %s, not %s, refresh and confirm again", body.Reference, digest, body.Digest)})
+		return
+	}
+	event := audit.Event{
+		Action:     audit.ActionDelete,
+		Result:     audit.ResultSuccess,
+		Registry:   req.Endpoint,
+		Repository: body.Repository,
+		Digest:     digest,
+	}
+	if body.Reference != digest {
+		event.Tag = body.Reference
+	}
+	if err := imagePush.DeleteManifest(ctx, body.Repository, digest); err != nil {
+		event.Result, event.Error = audit.ResultFailure, err.Error()
+		recordAudit(a, event)
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(a, event)
+	log.Infof("manifest %s/%s@%s (%s) deleted by %s", req.Endpoint, body.Repository, digest, body.Reference, a.username())
+	c.JSON(http.StatusOK, gin.H{"registry": req.Endpoint, "repository": body.Repository, "reference": body.Reference, "digest": digest})
+}
+
+// registryTagHandler 给仓库里的镜像加 tag，只推送 manifest，不会重新上传 layer，其他镜像的 tag 通过跨仓库挂载
+//
+//	POST /api/v1/registry/tag {"profile": "harbor-prod", "repository": "library/nginx", "reference": "1.25", "tags": ["stable", "team/nginx:1.25"]}
+func registryTagHandler(c *gin.Context) {
+	body, ok := bindBrowseRequest(c)
+	if !ok {
+		return
+	}
+	if body.Repository == "" || body.Reference == "" || len(body.Tags) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository, reference and tags are required"})
+		return
+	}
+	source := &util.Reference{Repository: body.Repository, Tag: body.Reference}
+	if strings.Contains(body.Reference, ":") {
+		source.Tag, source.Digest = "", body.Reference
+	}
+	targets := make([]*util.Reference, 0, len(body.Tags))
+	for _, tag := range body.Tags {
+		target, err := util.ParseTagTarget(source, tag)
+		if err == nil && target.Registry != "" {
+			err = fmt.Errorf("%s: registry is not allowed, tags are added in the same registry", tag)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		targets = append(targets, target)
+	}
+	imagePush, req, ok := registryClient(c, &body.pushRequest)
+	if !ok {
+		return
+	}
+	a := requestActor(c)
+	for _, repository := range append([]string{source.Repository}, targetRepositories(targets)...) {
+		if err := authorize(a, auth.ActionPush, req.Endpoint, repository); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), registryTimeout)
+	defer cancel()
+	digest, err := imagePush.Tag(ctx, source, targets)
+	for _, target := range targets {
+		event := audit.Event{
+			Action:     audit.ActionPush,
+			Result:     audit.ResultSuccess,
+			Registry:   req.Endpoint,
+			Repository: target.Repository,
+			Tag:        target.Tag,
+			Digest:     digest,
+		}
+		if err != nil {
+			event.Result, event.Error = audit.ResultFailure, err.Error()
+		}
+		recordAudit(a, event)
+	}
+	if err != nil {
+		c.JSON(registryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("%s/%s:%s tagged as %v by %s", req.Endpoint, body.Repository, body.Reference, body.Tags, a.username())
+	tags := make([]string, 0, len(targets))
+	for _, target := range targets {
+		tags = append(tags, target.String())
+	}
+	c.JSON(http.StatusOK, gin.H{"registry": req.Endpoint, "repository": body.Repository, "reference": body.Reference, "digest": digest, "tags": tags})
+}
+
+// targetRepositories 加 tag 的目标镜像，去掉重复的
+func targetRepositories(targets []*util.Reference) []string {
+	var repositories []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if !seen[target.Repository] {
+			seen[target.Repository] = true
+			repositories = append(repositories, target.Repository)
+		}
+	}
+	return repositories
+}
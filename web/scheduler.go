@@ -0,0 +1,130 @@
+package web
+
+import (
+	"sync"
+
+	"docker-tar-push-ui/pkg/util"
+)
+
+// scheduler 限制同时进行的推送个数，名额用完时按用户轮流分配，一个用户提交很多任务时不会让其他用户一直等待
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	queues  map[string][]*pushJob // 每个用户排队中的任务
+	order   []string              // 有任务排队的用户，按轮到的顺序
+}
+
+var (
+	jobScheduler = &scheduler{limit: 2, queues: map[string][]*pushJob{}}
+	// globalLimiter 所有推送共享的上传带宽
+	globalLimiter = util.NewRateLimiter(0)
+)
+
+func (sch *scheduler) setLimit(limit int) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.limit = limit
+	sch.dispatch()
+}
+
+// acquire 领取一个推送名额，排队期间任务被取消时返回 false；onQueued 在需要排队时调用，参数是其他排队中的任务个数
+func (sch *scheduler) acquire(job *pushJob, onQueued func(waiting int)) bool {
+	sch.mu.Lock()
+	if sch.running < sch.limit && len(sch.order) == 0 {
+		sch.running++
+		sch.mu.Unlock()
+		return true
+	}
+	key := job.queueKey()
+	if len(sch.queues[key]) == 0 {
+		sch.order = append(sch.order, key)
+	}
+	sch.queues[key] = append(sch.queues[key], job)
+	waiting := sch.waiting() - 1
+	sch.mu.Unlock()
+	if onQueued != nil {
+		onQueued(waiting)
+	}
+
+	select {
+	case <-job.ready:
+		return true
+	case <-job.canceled:
+	}
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	select {
+	case <-job.ready:
+		// 取消的同时刚好分配到名额，把名额还回去
+		sch.running--
+		sch.dispatch()
+	default:
+		sch.remove(job)
+	}
+	return false
+}
+
+// release 归还名额，交给下一个用户的任务
+func (sch *scheduler) release() {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.running--
+	sch.dispatch()
+}
+
+// dispatch 有空闲名额时按用户轮流唤醒排队的任务，调用方需要持有锁
+func (sch *scheduler) dispatch() {
+	for sch.running < sch.limit && len(sch.order) > 0 {
+		key := sch.order[0]
+		sch.order = sch.order[1:]
+		queue := sch.queues[key]
+		job := queue[0]
+		if len(queue) > 1 {
+			sch.queues[key] = queue[1:]
+			sch.order = append(sch.order, key)
+		} else {
+			delete(sch.queues, key)
+		}
+		sch.running++
+		close(job.ready)
+	}
+}
+
+func (sch *scheduler) remove(job *pushJob) {
+	key := job.queueKey()
+	queue := sch.queues[key]
+	for i, j := range queue {
+		if j == job {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		sch.queues[key] = queue
+		return
+	}
+	delete(sch.queues, key)
+	for i, k := range sch.order {
+		if k == key {
+			sch.order = append(sch.order[:i:i], sch.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// waiting 排队中的任务个数，调用方需要持有锁
+func (sch *scheduler) waiting() int {
+	n := 0
+	for _, queue := range sch.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// stats 正在进行和排队中的任务个数
+func (sch *scheduler) stats() (running, waiting int) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return sch.running, sch.waiting()
+}
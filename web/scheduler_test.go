@@ -0,0 +1,158 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestJob(user string) *pushJob {
+	return &pushJob{
+		pushJobStatus: pushJobStatus{User: user, Workspace: "default"},
+		ready:         make(chan struct{}),
+		canceled:      make(chan struct{}),
+	}
+}
+
+func newTestScheduler(limit int) *scheduler {
+	return &scheduler{limit: limit, queues: map[string][]*pushJob{}}
+}
+
+// enqueue 在后台排队，等任务进入队列后返回，acquire 的结果写到返回的 channel
+func enqueue(t *testing.T, sch *scheduler, job *pushJob) <-chan bool {
+	t.Helper()
+	queued := make(chan struct{})
+	result := make(chan bool, 1)
+	go func() {
+		result <- sch.acquire(job, func(int) { close(queued) })
+	}()
+	select {
+	case <-queued:
+	case ok := <-result:
+		t.Fatalf("job of %s got a slot without queuing (%v)", job.User, ok)
+	case <-time.After(time.Second):
+		t.Fatalf("job of %s was not queued", job.User)
+	}
+	return result
+}
+
+func isReady(job *pushJob) bool {
+	select {
+	case <-job.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	sch := newTestScheduler(1)
+	if !sch.acquire(newTestJob("a"), nil) {
+		t.Fatal("first job should get a slot")
+	}
+	a2, a3, b1, c1 := newTestJob("a"), newTestJob("a"), newTestJob("b"), newTestJob("c")
+	for _, job := range []*pushJob{a2, a3, b1, c1} {
+		enqueue(t, sch, job)
+	}
+	if running, waiting := sch.stats(); running != 1 || waiting != 4 {
+		t.Fatalf("stats = %d running, %d waiting, want 1, 4", running, waiting)
+	}
+	// 每个用户轮流一个，a 的第二个任务排在 b 和 c 后面
+	order := []*pushJob{a2, b1, c1, a3}
+	for i := range order {
+		sch.release()
+		for j, job := range order {
+			if isReady(job) != (j <= i) {
+				t.Fatalf("release %d: job %d (user %s) ready = %v, want %v", i, j, job.User, isReady(job), j <= i)
+			}
+		}
+	}
+	if running, waiting := sch.stats(); running != 1 || waiting != 0 {
+		t.Fatalf("stats = %d running, %d waiting, want 1, 0", running, waiting)
+	}
+}
+
+func TestSchedulerNoQueueJumping(t *testing.T) {
+	sch := newTestScheduler(1)
+	sch.acquire(newTestJob("a"), nil)
+	queued := newTestJob("b")
+	enqueue(t, sch, queued)
+	// 有任务排队时，新任务即使刚好有空闲名额也要排队
+	sch.mu.Lock()
+	sch.running--
+	sch.mu.Unlock()
+	late := newTestJob("c")
+	enqueue(t, sch, late)
+	sch.mu.Lock()
+	sch.dispatch()
+	sch.mu.Unlock()
+	if !isReady(queued) || isReady(late) {
+		t.Fatalf("queued job ready = %v, late job ready = %v, want true, false", isReady(queued), isReady(late))
+	}
+}
+
+func TestSchedulerCancelQueued(t *testing.T) {
+	sch := newTestScheduler(1)
+	sch.acquire(newTestJob("a"), nil)
+	b1, b2 := newTestJob("b"), newTestJob("b")
+	r1 := enqueue(t, sch, b1)
+	enqueue(t, sch, b2)
+	b1.cancel()
+	if ok := <-r1; ok {
+		t.Fatal("canceled job should not get a slot")
+	}
+	if running, waiting := sch.stats(); running != 1 || waiting != 1 {
+		t.Fatalf("stats = %d running, %d waiting, want 1, 1", running, waiting)
+	}
+	sch.release()
+	if !isReady(b2) {
+		t.Fatal("the remaining job should get the released slot")
+	}
+	sch.release()
+	if running, waiting := sch.stats(); running != 0 || waiting != 0 || len(sch.order) != 0 || len(sch.queues) != 0 {
+		t.Fatalf("scheduler not empty: %d running, %d waiting, order %v", running, waiting, sch.order)
+	}
+}
+
+// 任务被分配到名额的同时被取消，名额要么被任务使用，要么交给下一个任务，不能丢失
+func TestSchedulerCancelWhileDispatched(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		sch := newTestScheduler(1)
+		sch.acquire(newTestJob("a"), nil)
+		b, c := newTestJob("b"), newTestJob("c")
+		rb := enqueue(t, sch, b)
+		enqueue(t, sch, c)
+
+		sch.mu.Lock()
+		sch.running--
+		sch.dispatch()
+		b.cancel()
+		sch.mu.Unlock()
+
+		if ok := <-rb; ok {
+			// b 先看到了名额，正常使用后归还
+			sch.release()
+		}
+		if !isReady(c) {
+			t.Fatalf("iteration %d: the slot was lost after cancel", i)
+		}
+		sch.release()
+		if running, waiting := sch.stats(); running != 0 || waiting != 0 {
+			t.Fatalf("iteration %d: stats = %d running, %d waiting, want 0, 0", i, running, waiting)
+		}
+	}
+}
+
+func TestSchedulerSetLimit(t *testing.T) {
+	sch := newTestScheduler(1)
+	sch.acquire(newTestJob("a"), nil)
+	b, c := newTestJob("b"), newTestJob("c")
+	enqueue(t, sch, b)
+	enqueue(t, sch, c)
+	sch.setLimit(3)
+	if !isReady(b) || !isReady(c) {
+		t.Fatal("raising the limit should dispatch the queued jobs")
+	}
+	if running, waiting := sch.stats(); running != 3 || waiting != 0 {
+		t.Fatalf("stats = %d running, %d waiting, want 3, 0", running, waiting)
+	}
+}
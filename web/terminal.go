@@ -0,0 +1,48 @@
+package web
+
+import (
+	"sync"
+
+	"docker-tar-push-ui/pkg/auth"
+
+	"github.com/olahol/melody"
+)
+
+// terminalKey 终端连接的状态在 melody session 里的 key
+const terminalKey = "terminal"
+
+// terminalState 一个终端连接的状态，连接建立时确定用户和工作空间，每个连接同时只能有一个推送任务
+type terminalState struct {
+	Workspace string
+	Identity  *auth.Identity
+	IP        string
+
+	mu  sync.Mutex
+	job *pushJob
+}
+
+// terminalOf 终端连接的状态，没有时返回默认工作空间的匿名状态
+func terminalOf(s *melody.Session) *terminalState {
+	if v, ok := s.Get(terminalKey); ok {
+		if t, ok := v.(*terminalState); ok {
+			return t
+		}
+	}
+	return &terminalState{Workspace: defaultWorkspace}
+}
+
+// activeJob 正在进行的推送任务
+func (t *terminalState) activeJob() *pushJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.job != nil && !t.job.done() {
+		return t.job
+	}
+	return nil
+}
+
+func (t *terminalState) setJob(job *pushJob) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.job = job
+}
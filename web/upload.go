@@ -0,0 +1,354 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"docker-tar-push-ui/pkg/audit"
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/log"
+)
+
+// 分片上传的临时目录，未完成的文件和进度都保存在这里，服务重启后也可以继续上传
+const partialDirName = ".partial"
+
+// uploadSession 一次可断点续传的上传
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Sha256    string    `json:"sha256,omitempty"`    // 客户端期望的 sha256，完成时校验
+	HashState []byte    `json:"hashState,omitempty"` // 已写入数据的 sha256 中间状态，续传时不需要重新读取文件
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	dir string // 所属工作空间目录
+}
+
+var (
+	sessionMu    sync.Mutex
+	sessionLocks = map[string]*sync.Mutex{}
+)
+
+// lockSession 同一个上传同时只允许一个请求写入
+func lockSession(id string) func() {
+	sessionMu.Lock()
+	l, ok := sessionLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		sessionLocks[id] = l
+	}
+	sessionMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// forgetSession 上传完成、取消或者不存在时删除对应的锁，调用时需要持有这个上传的锁
+func forgetSession(id string) {
+	sessionMu.Lock()
+	delete(sessionLocks, id)
+	sessionMu.Unlock()
+}
+
+func partialDir(dir string) string {
+	return path.Join(dir, partialDirName)
+}
+
+func (s *uploadSession) dataPath() string {
+	return path.Join(partialDir(s.dir), s.ID+".part")
+}
+
+func (s *uploadSession) metaPath() string {
+	return path.Join(partialDir(s.dir), s.ID+".json")
+}
+
+func (s *uploadSession) save() error {
+	s.UpdatedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.metaPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.metaPath())
+}
+
+func (s *uploadSession) hasher() (hash.Hash, error) {
+	h := sha256.New()
+	if len(s.HashState) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.HashState); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func loadSession(dir, id string) (*uploadSession, error) {
+	// id 只允许是生成的十六进制字符串，防止拼出其他路径
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, fmt.Errorf("invalid upload id %q", id)
+	}
+	data, err := os.ReadFile(path.Join(partialDir(dir), id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	s := &uploadSession{dir: dir}
+	return s, json.Unmarshal(data, s)
+}
+
+func listSessions(dir string) []*uploadSession {
+	sessions := []*uploadSession{}
+	files, _ := filepath.Glob(path.Join(partialDir(dir), "*.json"))
+	for _, file := range files {
+		id := filepath.Base(file)
+		if s, err := loadSession(dir, id[:len(id)-len(".json")]); err == nil {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// createUploadHandler 创建上传，客户端从返回的 offset 处开始上传
+//
+// 续传需要带上之前的上传 id，或者期望的 sha256（与未完成的上传的文件名、大小和 sha256 都一致时续传），只有文件名和大小一致不会续传
+func createUploadHandler(c *gin.Context) {
+	var req struct {
+		ID       string `json:"id"`
+		Filename string `json:"filename" binding:"required"`
+		Size     int64  `json:"size"`
+		Sha256   string `json:"sha256"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid size"})
+		return
+	}
+	if maxUploadSize > 0 && req.Size > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file is larger than " + util.FormatSize(maxUploadSize)})
+		return
+	}
+	filename, err := util.SanitizeFileName(req.Filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dir := workspaceDir(c)
+	sum := normalizeChecksum(req.Sha256)
+	if sum == "" {
+		sum = normalizeChecksum(c.GetHeader("X-Checksum-Sha256"))
+	}
+	for _, s := range listSessions(dir) {
+		if s.Filename != filename || s.Size != req.Size {
+			continue
+		}
+		if (req.ID != "" && s.ID == req.ID) || (sum != "" && s.Sha256 == sum) {
+			log.Infof("resume upload %s of %s at offset %d", s.ID, s.Filename, s.Offset)
+			c.JSON(http.StatusOK, s)
+			return
+		}
+	}
+	if err := os.MkdirAll(partialDir(dir), 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s := &uploadSession{ID: newUploadID(), Filename: filename, Size: req.Size, Sha256: sum, CreatedAt: time.Now(), dir: dir}
+	f, err := os.Create(s.dataPath())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	f.Close()
+	if err := s.save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("create upload %s for %s (%d bytes)", s.ID, s.Filename, s.Size)
+	c.JSON(http.StatusCreated, s)
+}
+
+func listUploadsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, listSessions(workspaceDir(c)))
+}
+
+// getUploadHandler 查询当前的上传进度，HEAD 请求通过 Upload-Offset 头返回
+func getUploadHandler(c *gin.Context) {
+	s, err := loadSession(workspaceDir(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(s.Size, 10))
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// patchUploadHandler 追加一个分片，请求头 Upload-Offset 必须等于服务端记录的进度
+func patchUploadHandler(c *gin.Context) {
+	start := time.Now()
+	id := c.Param("id")
+	unlock := lockSession(id)
+	defer unlock()
+
+	s, err := loadSession(workspaceDir(c), id)
+	if err != nil {
+		forgetSession(id)
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != s.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "offset mismatch", "offset": s.Offset})
+		return
+	}
+
+	f, err := os.OpenFile(s.dataPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	// 丢掉上一次中断时写了一半的数据
+	if err := f.Truncate(s.Offset); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h, err := s.hasher()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	body := io.LimitReader(c.Request.Body, s.Size-s.Offset)
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	observeUpload(start, n)
+	if err != nil {
+		// 分片没有完整写入，进度保持不变，客户端重新发送这个分片即可
+		log.Errorf("upload %s write chunk failed: %v", s.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "offset": s.Offset})
+		return
+	}
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.Offset += n
+	s.HashState = state
+	if err := s.save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	c.JSON(http.StatusOK, gin.H{"offset": s.Offset})
+}
+
+// completeUploadHandler 上传完成，校验 sha256 后移动到上传目录
+//
+// 期望的 sha256 可以在创建时、完成时的 body 或 X-Checksum-Sha256 请求头中传入，也可以提前上传 .sha256 校验文件
+func completeUploadHandler(c *gin.Context) {
+	id := c.Param("id")
+	unlock := lockSession(id)
+	defer unlock()
+
+	var req struct {
+		Sha256 string `json:"sha256"`
+	}
+	c.ShouldBindJSON(&req)
+	s, err := loadSession(workspaceDir(c), id)
+	if err != nil {
+		forgetSession(id)
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	if s.Offset != s.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload is not finished", "offset": s.Offset})
+		return
+	}
+	h, err := s.hasher()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	expected := normalizeChecksum(req.Sha256)
+	if expected == "" {
+		expected = normalizeChecksum(c.GetHeader("X-Checksum-Sha256"))
+	}
+	if expected == "" {
+		expected = s.Sha256
+	}
+	// 校验失败时数据文件会被删除，上传需要重新开始；服务端的错误（例如移动文件失败）时数据文件还在，保留上传，客户端可以重新完成
+	code, err := storeUploadedFile(s.dir, s.dataPath(), s.Filename, s.Size, sum, expected)
+	if _, statErr := os.Stat(s.dataPath()); err == nil || code < http.StatusInternalServerError || statErr != nil {
+		os.Remove(s.metaPath())
+		forgetSession(id)
+	}
+	event := audit.Event{Action: audit.ActionUpload, Result: audit.ResultSuccess, Archive: s.Filename, Sha256: sum, Size: s.Size}
+	if err != nil {
+		event.Result, event.Error = audit.ResultFailure, err.Error()
+		recordUpload(c, event)
+		c.JSON(code, gin.H{"error": err.Error(), "sha256": sum})
+		return
+	}
+	recordUpload(c, event)
+	log.Infof("upload %s done: %s sha256:%s", s.ID, s.Filename, sum)
+	c.JSON(http.StatusOK, gin.H{"message": "文件上传成功" + s.Filename, "sha256": sum})
+}
+
+func deleteUploadHandler(c *gin.Context) {
+	id := c.Param("id")
+	unlock := lockSession(id)
+	defer unlock()
+
+	s, err := loadSession(workspaceDir(c), id)
+	if err != nil {
+		forgetSession(id)
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	os.Remove(s.dataPath())
+	os.Remove(s.metaPath())
+	forgetSession(id)
+	c.JSON(http.StatusOK, gin.H{"message": "upload aborted"})
+}
+
+// recordUpload 上传完成（或者校验失败）时写审计日志和指标
+func recordUpload(c *gin.Context, event audit.Event) {
+	uploadsTotal.WithLabelValues(event.Result).Inc()
+	recordAudit(requestActor(c), event)
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"docker-tar-push-ui/pkg/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olahol/melody"
+)
+
+// 每个用户/团队的上传文件放在 uploadDir/<workspace> 下，互不影响
+const defaultWorkspace = "default"
+
+var workspaceRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// workspaceMiddleware 解析当前请求的工作空间，依次取请求头 X-Workspace、参数 workspace、cookie workspace
+//
+// 开启认证后普通用户只能使用自己的工作空间，管理员可以指定任意工作空间
+func workspaceMiddleware(c *gin.Context) {
+	if identity := identityOf(c); identity != nil && !identity.IsAdmin() {
+		c.Set("workspace", identityWorkspace(identity))
+		c.Next()
+		return
+	}
+	ws := c.GetHeader("X-Workspace")
+	if ws == "" {
+		ws = c.Query("workspace")
+	}
+	if ws == "" {
+		ws, _ = c.Cookie("workspace")
+	}
+	if ws == "" {
+		ws = defaultWorkspace
+	}
+	if !workspaceRe.MatchString(ws) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid workspace %q", ws)})
+		return
+	}
+	c.Set("workspace", ws)
+	c.Next()
+}
+
+// workspaceOf 当前请求的工作空间
+func workspaceOf(c *gin.Context) string {
+	return c.GetString("workspace")
+}
+
+// workspaceDir 当前请求的工作空间目录
+func workspaceDir(c *gin.Context) string {
+	return path.Join(uploadDir, workspaceOf(c))
+}
+
+// sessionWorkspaceDir WebSocket 连接建立时记录的工作空间目录
+func sessionWorkspaceDir(s *melody.Session) string {
+	return path.Join(uploadDir, terminalOf(s).Workspace)
+}
+
+// resolveArchive 把推送命令里的镜像包参数解析成工作空间内的路径，不允许引用工作空间以外的文件
+//
+// 参数可以是 /files 返回的 address，也可以只是相对工作空间的文件名
+func resolveArchive(dir, arg string) (string, error) {
+	name := filepath.ToSlash(filepath.Clean(arg))
+	if prefix := filepath.ToSlash(filepath.Clean(dir)) + "/"; strings.HasPrefix(name, prefix) {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	return util.SafeJoin(dir, name)
+}
+
+// listArchives 列出目录下的镜像包，分卷包归并成一条
+func listArchives(dir string) ([]*util.Archive, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if !file.IsDir() {
+			paths = append(paths, path.Join(dir, file.Name()))
+		}
+	}
+	return util.ScanArchives(paths), nil
+}
+
+// archiveRecords 镜像包列表，给 /files 接口使用
+func archiveRecords(dir string) []map[string]interface{} {
+	var records []map[string]interface{}
+	archives, err := listArchives(dir)
+	if err != nil {
+		return records
+	}
+	// 分卷包归并成一条记录，address 为逻辑路径，推送时会自动找到所有分片
+	for _, archive := range archives {
+		record := map[string]interface{}{
+			"name":    archive.Name,
+			"address": archive.Path,
+			"parts":   len(archive.Parts),
+			"sha256":  archiveChecksum(dir, archive),
+		}
+		if err := archive.Check(); err != nil {
+			record["error"] = err.Error()
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// removeArchive 删除工作空间内的一个镜像包，分卷包会删除所有分片，同时删除校验文件和元数据，返回镜像包的 sha256
+func removeArchive(dir, name string) (string, error) {
+	name, err := util.SanitizeFileName(name)
+	if err != nil {
+		return "", err
+	}
+	archives, err := util.FindArchives(path.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	sum := ""
+	if len(archives) == 1 {
+		sum = archiveChecksum(dir, archives[0])
+	}
+	for _, archive := range archives {
+		for _, part := range archive.Parts {
+			if err := os.Remove(part); err != nil {
+				return sum, err
+			}
+			os.Remove(metaPath(dir, filepath.Base(part)))
+		}
+		os.Remove(archive.ChecksumPath())
+	}
+	return sum, nil
+}
+
+// adminFilesHandler 管理员视图，列出所有工作空间的镜像包
+func adminFilesHandler(c *gin.Context) {
+	records := []map[string]interface{}{}
+	entries, err := os.ReadDir(uploadDir)
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() || !workspaceRe.MatchString(entry.Name()) {
+				continue
+			}
+			for _, record := range archiveRecords(path.Join(uploadDir, entry.Name())) {
+				record["workspace"] = entry.Name()
+				records = append(records, record)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, records)
+}